@@ -82,6 +82,12 @@ func HandleRequest(w http.ResponseWriter, r *http.Request) {
 var createTableRequests = make(map[string]bool)
 var queryRequests = make(map[string]time.Time)
 
+// rawQueryOutputLocations are where the results of queries which list records rather than count them are said to be.
+// Nothing is written there, tests put the CSV they expect at rawQueryResultsKey in the output bucket themselves.
+var rawQueryOutputLocations = make(map[string]string)
+
+const rawQueryResultsKey = "mock-raw-query-results.csv"
+
 func startQuery(request StartQueryExecutionInput) (interface{}, int) {
 	log.Printf("Got start query request: %+v", request)
 
@@ -90,6 +96,10 @@ func startQuery(request StartQueryExecutionInput) (interface{}, int) {
 		createTableRequests[id] = true
 	} else if strings.Contains(*request.QueryString, "SELECT ") {
 		queryRequests[id] = time.Now()
+		if !strings.Contains(*request.QueryString, "GROUPING SETS") && request.ResultConfiguration != nil &&
+			request.ResultConfiguration.OutputLocation != nil {
+			rawQueryOutputLocations[id] = *request.ResultConfiguration.OutputLocation + rawQueryResultsKey
+		}
 	}
 
 	return StartQueryExecutionOutput{QueryExecutionId: &id}, 200
@@ -112,6 +122,11 @@ func getQueryExecution(request GetQueryExecutionInput) (interface{}, int) {
 		state = types.QueryExecutionStateFailed
 	}
 
+	outputLocation := "s3://somebucket"
+	if rawQueryOutputLocation, rawQuery := rawQueryOutputLocations[*request.QueryExecutionId]; rawQuery {
+		outputLocation = rawQueryOutputLocation
+	}
+
 	return GetQueryExecutionOutput{
 		QueryExecution: &QueryExecution{
 			EngineVersion: &EngineVersion{
@@ -128,7 +143,7 @@ func getQueryExecution(request GetQueryExecutionInput) (interface{}, int) {
 				AclConfiguration:        &AclConfiguration{},
 				EncryptionConfiguration: nil,
 				ExpectedBucketOwner:     nil,
-				OutputLocation:          StringPtr("s3://somebucket"),
+				OutputLocation:          StringPtr(outputLocation),
 			},
 			StatementType: "",
 			Statistics:    nil,
@@ -157,23 +172,90 @@ func getQueryResults(request GetQueryResultsInput) (interface{}, int) {
 		}, 200
 	} else if queryRequestedAt, queryRequestExists := queryRequests[*request.QueryExecutionId]; queryRequestExists {
 		if queryRequestedAt.Add(time.Second * 5).Before(time.Now()) {
+			// The results are split over two pages so the service has to follow the NextToken
+			if request.NextToken == nil {
+				return GetQueryResultsOutput{
+					NextToken: StringPtr("page-2"),
+					ResultSet: &ResultSet{
+						ResultSetMetadata: nil,
+						Rows: []Row{
+							{Data: []Datum{
+								{VarCharValue: StringPtr("grouping")},
+								{VarCharValue: StringPtr("product")},
+								{VarCharValue: StringPtr("android_id")},
+								{VarCharValue: StringPtr("method")},
+								{VarCharValue: StringPtr("path")},
+								{VarCharValue: StringPtr("hour")},
+								{VarCharValue: StringPtr("value")},
+							}},
+							{Data: []Datum{
+								{VarCharValue: StringPtr("15")},
+								{VarCharValue: StringPtr("Product A")},
+								{},
+								{},
+								{},
+								{},
+								{VarCharValue: StringPtr("54")},
+							}},
+							{Data: []Datum{
+								{VarCharValue: StringPtr("14")},
+								{VarCharValue: StringPtr("Product A")},
+								{},
+								{},
+								{},
+								{VarCharValue: StringPtr("1655542800")},
+								{VarCharValue: StringPtr("50")},
+							}},
+							{Data: []Datum{
+								{VarCharValue: StringPtr("14")},
+								{VarCharValue: StringPtr("Product A")},
+								{},
+								{},
+								{},
+								{VarCharValue: StringPtr("1655546400")},
+								{VarCharValue: StringPtr("4")},
+							}},
+						},
+						noSmithyDocumentSerde: noSmithyDocumentSerde{},
+					},
+					UpdateCount:           IntPtr(0),
+					ResultMetadata:        middleware2.Metadata{},
+					noSmithyDocumentSerde: noSmithyDocumentSerde{},
+				}, 200
+			}
+
 			return GetQueryResultsOutput{
 				NextToken: nil,
 				ResultSet: &ResultSet{
 					ResultSetMetadata: nil,
 					Rows: []Row{
 						{Data: []Datum{
-							{VarCharValue: StringPtr("Product Name")},
-							{VarCharValue: StringPtr("Value")},
-						}},
-						{Data: []Datum{
-							{VarCharValue: StringPtr("Product A")},
-							{VarCharValue: StringPtr("54")},
+							{VarCharValue: StringPtr("15")},
+							{VarCharValue: StringPtr("Product B")},
+							{},
+							{},
+							{},
+							{},
+							{VarCharValue: StringPtr("122")},
 						}},
 						{Data: []Datum{
+							{VarCharValue: StringPtr("14")},
 							{VarCharValue: StringPtr("Product B")},
+							{},
+							{},
+							{},
+							{VarCharValue: StringPtr("1655542800")},
 							{VarCharValue: StringPtr("122")},
 						}},
+						{Data: []Datum{
+							{VarCharValue: StringPtr("23")},
+							{},
+							{VarCharValue: StringPtr("tablet-1")},
+							{},
+							{},
+							{},
+							{VarCharValue: StringPtr("176")},
+						}},
 					},
 					noSmithyDocumentSerde: noSmithyDocumentSerde{},
 				},
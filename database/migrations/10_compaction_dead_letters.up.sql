@@ -0,0 +1,2 @@
+ALTER TABLE compaction_day ADD COLUMN dead_letter_count BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE compaction_day ADD COLUMN unreadable_object_count INT NOT NULL DEFAULT 0;
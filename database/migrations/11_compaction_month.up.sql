@@ -0,0 +1,19 @@
+CREATE TABLE compaction_month (
+    subscription_id UUID NOT NULL,
+    month DATE NOT NULL,
+    status VARCHAR(255) NOT NULL,
+    source_object_count INT NOT NULL,
+    record_count BIGINT NOT NULL,
+    part_count INT NOT NULL,
+    output_prefix VARCHAR(1024),
+    source_bytes BIGINT NOT NULL,
+    output_bytes BIGINT NOT NULL,
+    duplicate_count BIGINT NOT NULL,
+    dead_letter_count BIGINT NOT NULL,
+    unreadable_object_count INT NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (subscription_id, month),
+    FOREIGN KEY (subscription_id) REFERENCES subscription(id)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE cron_job_run (
+    id UUID NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    host VARCHAR(255) NOT NULL,
+    trigger VARCHAR(255) NOT NULL,
+    status VARCHAR(255) NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ended_at TIMESTAMP WITH TIME ZONE,
+    error TEXT,
+    summary JSONB NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX cron_job_run_name_started_at ON cron_job_run (name, started_at DESC);
+
+-- Only one run of each job can be in progress at once
+CREATE UNIQUE INDEX cron_job_run_running ON cron_job_run (name) WHERE status = 'running';
@@ -0,0 +1 @@
+ALTER TABLE cron_job_lock ADD COLUMN fencing_token BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+ALTER TABLE usage_report_instance ADD COLUMN failed_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE usage_report_instance ADD COLUMN failure_reason TEXT;
+
+CREATE INDEX usage_report_instance_pending ON usage_report_instance (requested_at)
+    WHERE completed_at IS NULL AND failed_at IS NULL;
@@ -0,0 +1,10 @@
+ALTER TABLE usage_report_instance ADD COLUMN status VARCHAR(255) NOT NULL DEFAULT 'pending';
+ALTER TABLE usage_report_instance ADD COLUMN attempts INT NOT NULL DEFAULT 1;
+ALTER TABLE usage_report_instance ADD COLUMN next_attempt_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE usage_report_instance SET status = 'completed' WHERE completed_at IS NOT NULL;
+UPDATE usage_report_instance SET status = 'failed' WHERE failed_at IS NOT NULL;
+
+DROP INDEX usage_report_instance_pending;
+CREATE INDEX usage_report_instance_pending ON usage_report_instance (status, next_attempt_at)
+    WHERE status IN ('pending', 'retrying');
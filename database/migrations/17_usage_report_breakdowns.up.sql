@@ -0,0 +1,20 @@
+ALTER TABLE usage_report_instance ADD COLUMN breakdowns VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE usage_report_instance_breakdown (
+    usage_report_instance_id UUID NOT NULL,
+    breakdown VARCHAR(255) NOT NULL,
+    product VARCHAR(255) NOT NULL,
+    android_id VARCHAR(255) NOT NULL,
+    method VARCHAR(255) NOT NULL,
+    path VARCHAR(1024) NOT NULL,
+    value INT NOT NULL,
+    FOREIGN KEY (usage_report_instance_id) REFERENCES usage_report_instance(id)
+);
+
+-- The dimensions are unique by their hash, as together they can be longer than a btree index entry is allowed to be.
+-- They are joined with the unit separator, which none of them are expected to hold, so that moving a character between
+-- them changes the hash.
+CREATE UNIQUE INDEX usage_report_instance_breakdown_dimensions ON usage_report_instance_breakdown (
+    usage_report_instance_id, breakdown,
+    md5(product || E'\x1f' || android_id || E'\x1f' || method || E'\x1f' || path)
+);
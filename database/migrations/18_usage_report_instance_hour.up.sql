@@ -0,0 +1,8 @@
+CREATE TABLE usage_report_instance_hour (
+    usage_report_instance_id UUID NOT NULL,
+    product VARCHAR(255) NOT NULL,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    value INT NOT NULL,
+    PRIMARY KEY (usage_report_instance_id, product, hour),
+    FOREIGN KEY (usage_report_instance_id) REFERENCES usage_report_instance(id)
+);
@@ -0,0 +1,27 @@
+CREATE TABLE usage_query (
+    id UUID NOT NULL,
+    subscription_id UUID NOT NULL,
+    starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    requested_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    athena_query_id VARCHAR(255) NOT NULL,
+    status VARCHAR(255) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 1,
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    failed_at TIMESTAMP WITH TIME ZONE,
+    failure_reason TEXT,
+    PRIMARY KEY (id),
+    FOREIGN KEY (subscription_id) REFERENCES subscription(id)
+);
+
+CREATE INDEX usage_query_pending ON usage_query (status, next_attempt_at)
+    WHERE status IN ('pending', 'retrying');
+
+CREATE TABLE usage_query_product (
+    usage_query_id UUID NOT NULL,
+    product VARCHAR(255) NOT NULL,
+    value INT NOT NULL,
+    PRIMARY KEY (usage_query_id, product),
+    FOREIGN KEY (usage_query_id) REFERENCES usage_query(id)
+);
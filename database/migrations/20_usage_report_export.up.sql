@@ -0,0 +1,20 @@
+CREATE TABLE usage_report_export (
+    id UUID NOT NULL,
+    usage_report_instance_id UUID NOT NULL,
+    format VARCHAR(255) NOT NULL,
+    level VARCHAR(255) NOT NULL,
+    object_key TEXT NOT NULL,
+    requested_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    athena_query_id VARCHAR(255) NOT NULL,
+    status VARCHAR(255) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 1,
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    failed_at TIMESTAMP WITH TIME ZONE,
+    failure_reason TEXT,
+    PRIMARY KEY (id),
+    FOREIGN KEY (usage_report_instance_id) REFERENCES usage_report_instance(id)
+);
+
+CREATE INDEX usage_report_export_pending ON usage_report_export (status, next_attempt_at)
+    WHERE status IN ('pending', 'retrying');
@@ -0,0 +1,34 @@
+CREATE TABLE compaction_day (
+    subscription_id UUID NOT NULL,
+    day DATE NOT NULL,
+    status VARCHAR(255) NOT NULL,
+    source_object_count INT NOT NULL,
+    record_count BIGINT NOT NULL,
+    output_key VARCHAR(1024),
+    source_bytes BIGINT NOT NULL,
+    output_bytes BIGINT NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (subscription_id, day),
+    FOREIGN KEY (subscription_id) REFERENCES subscription(id)
+);
+
+-- The checkpoint only held when each Subscription last succeeded, meaning every day before that one had been compacted,
+-- so mark those days as succeeded to stop them being compacted again and let months before the ledger be rolled up.
+-- The checkpoint moved past days which failed after an earlier day in the same run had succeeded, so it cannot be
+-- trusted for a Subscription which has ever failed, and those are left for the cron to compact again from creation.
+-- The counts and output key were never recorded, so are left empty.
+INSERT INTO compaction_day (subscription_id, day, status, source_object_count, record_count, output_key, source_bytes,
+                            output_bytes, attempts, last_error, updated_at)
+SELECT compaction_checkpoint.subscription_id, compacted_day::DATE, 'succeeded', 0, 0, NULL, 0, 0, 1, NULL,
+       compaction_checkpoint.succeeded_at
+FROM compaction_checkpoint
+JOIN subscription ON subscription.id = compaction_checkpoint.subscription_id
+CROSS JOIN LATERAL generate_series(
+    date_trunc('day', subscription.created_at AT TIME ZONE 'UTC'),
+    date_trunc('day', compaction_checkpoint.succeeded_at AT TIME ZONE 'UTC') - INTERVAL '1 day',
+    INTERVAL '1 day') AS compacted_day
+WHERE compaction_checkpoint.succeeded_at IS NOT NULL AND compaction_checkpoint.failed_at IS NULL;
+
+DROP TABLE compaction_checkpoint;
@@ -0,0 +1 @@
+ALTER TABLE compaction_day ADD COLUMN content_sha256 VARCHAR(64);
@@ -0,0 +1 @@
+ALTER TABLE compaction_day ADD COLUMN duplicate_count BIGINT NOT NULL DEFAULT 0;
@@ -1,3 +1,6 @@
 INSERT INTO api_key values ('Test', 'apikey123');
 INSERT INTO api_key_permission values ('Test', 'get-subscription');
 INSERT INTO api_key_permission values ('Test', 'create-subscription');
+INSERT INTO api_key_permission values ('Test', 'get-compactions');
+INSERT INTO api_key_permission values ('Test', 'manage-cron-jobs');
+INSERT INTO api_key_permission values ('Test', 'query-usage');
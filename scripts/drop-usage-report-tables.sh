@@ -0,0 +1,19 @@
+#!/bin/bash
+
+# Drops the per Subscription-month tables created before usage reports moved to the partitioned access_logs table.
+set -e
+
+database=$1
+if [ -z "$database" ]; then
+  echo "Usage: $0 <athena-database>"
+  exit 1
+fi
+
+tables=$(aws glue get-tables --database-name "$database" \
+  --expression 'usage_report_.*' --query 'TableList[].Name' --output text)
+
+for table in $tables
+do
+  echo "Dropping $table"
+  aws glue delete-table --database-name "$database" --name "$table"
+done
@@ -3,12 +3,15 @@ set -e
 
 ./scripts/run-integration-k3d.sh &
 
-until [ \
-  "$(curl -s -w '%{http_code}' -o /dev/null "http://localhost:8020/healthcheck")" \
-  -eq 200 ]
+for port in 8020 8021
 do
-  echo "Waiting for application to start up."
-  sleep 1
+  until [ \
+    "$(curl -s -w '%{http_code}' -o /dev/null "http://localhost:$port/healthcheck")" \
+    -eq 200 ]
+  do
+    echo "Waiting for application on $port to start up."
+    sleep 1
+  done
 done
 
 echo "Starting integration tests"
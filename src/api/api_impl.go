@@ -5,7 +5,11 @@ import (
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 	"net/http"
+	"net/url"
+	"subscriptions/src/config"
+	"subscriptions/src/cron"
 	db "subscriptions/src/database"
+	"subscriptions/src/ingestion"
 	"subscriptions/src/models"
 	"subscriptions/src/monitoring"
 	"subscriptions/src/services"
@@ -20,13 +24,22 @@ var Implementation = &Impl{}
 //Your IDE should tell you here if you're not implementing all the endpoints
 var _ ServerInterface = (*Impl)(nil)
 
-func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, usageReportId string) error {
+func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, usageReportId string, params GetSubscriptionsSubscriptionIdUsageReportsUsageReportIdParams) error {
 	usageReportUUID, err := uuid2.Parse(usageReportId)
 	if err != nil {
 		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
 		return nil
 	}
 
+	granularity := seriesGranularityDay
+	if params.Granularity != nil {
+		granularity = *params.Granularity
+	}
+	if granularity != seriesGranularityDay && granularity != seriesGranularityHour {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
 	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
 	if err != nil {
 		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
@@ -61,7 +74,7 @@ func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.C
 		return nil
 	}
 
-	usageReportInstances, err := services.CheckUsageReportInstances(monitoringContext, usageReportUUID)
+	usageReportInstances, err := db.GetUsageReportInstances(monitoringContext, usageReportUUID)
 	if err != nil {
 		monitoringContext.Error("Unable to get Usage Report instances", zap.Error(err), zap.String("usageReportId", usageReportId))
 		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
@@ -70,13 +83,18 @@ func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.C
 
 	var newestCompletedInstance *models.UsageReportInstance
 	var pendingInstance *models.UsageReportInstance
+	var newestInstance *models.UsageReportInstance
 	for _, instance := range usageReportInstances {
 		instancee := instance
+		if newestInstance == nil || newestInstance.RequestedAt.Before(instance.RequestedAt) {
+			newestInstance = &instancee
+		}
+
 		if (newestCompletedInstance == nil || newestCompletedInstance.RequestedAt.Before(instance.RequestedAt)) && !utils.IsNil(instance.CompletedAt) {
 			newestCompletedInstance = &instancee
 		}
 
-		if instance.CompletedAt == nil {
+		if instance.IsPending() {
 			pendingInstance = &instancee
 		}
 	}
@@ -85,8 +103,12 @@ func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.C
 	to := utils.ToNextMonth(from)
 
 	state := "not_requested"
+	var failureReason *string
 	if pendingInstance != nil {
 		state = "processing"
+	} else if newestInstance != nil && newestInstance.IsFailed() {
+		state = "failed"
+		failureReason = newestInstance.FailureReason
 	} else if newestCompletedInstance != nil {
 		state = "ready"
 	}
@@ -105,13 +127,37 @@ func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.C
 			products.Set(product.Product, product.Value)
 		}
 
+		instanceHours, err := db.GetUsageReportInstanceHours(monitoringContext, newestCompletedInstance.Id)
+		if err != nil {
+			monitoringContext.Error("Unable to get Usage Report Instance Hours", zap.Error(err), zap.String("usageReportInstanceId", newestCompletedInstance.Id.String()))
+			noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+			return nil
+		}
+
+		series := mapUsageReportSeries(from, to, granularity, instanceHours)
+
+		var breakdowns *UsageReportBreakdowns
+		if len(newestCompletedInstance.Breakdowns) > 0 {
+			instanceBreakdowns, err := db.GetUsageReportInstanceBreakdowns(monitoringContext, newestCompletedInstance.Id)
+			if err != nil {
+				monitoringContext.Error("Unable to get Usage Report Instance Breakdowns", zap.Error(err), zap.String("usageReportInstanceId", newestCompletedInstance.Id.String()))
+				noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+				return nil
+			}
+
+			breakdowns = mapUsageReportBreakdowns(newestCompletedInstance.Breakdowns, instanceBreakdowns)
+		}
+
 		jsonContentOrLog(monitoringContext, ctx, http.StatusOK, UsageReport{
 			Id:                usageReportUUID,
 			From:              from.Unix(),
 			To:                to.Unix(),
 			ReportCompletedAt: utils.Int64Ptr(newestCompletedInstance.CompletedAt.Unix()),
 			State:             state,
+			FailureReason:     failureReason,
 			Products:          &products,
+			Series:            &series,
+			Breakdowns:        breakdowns,
 		})
 		return nil
 	}
@@ -122,11 +168,93 @@ func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.C
 		To:                to.Unix(),
 		ReportCompletedAt: nil,
 		State:             state,
+		FailureReason:     failureReason,
 		Products:          nil,
 	})
 	return nil
 }
 
+const (
+	seriesGranularityDay  = "day"
+	seriesGranularityHour = "hour"
+)
+
+// mapUsageReportSeries adds up the hours into a point for every day or hour from the start of the report to the end,
+// including those without usage
+func mapUsageReportSeries(from time.Time, to time.Time, granularity string, instanceHours []models.UsageReportInstanceHour) []UsageReportSeriesPoint {
+	next := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	truncate := utils.ToDay
+	if granularity == seriesGranularityHour {
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+		truncate = func(t time.Time) time.Time { return t.Truncate(time.Hour) }
+	}
+
+	series := make([]UsageReportSeriesPoint, 0)
+	points := make(map[int64]int)
+	for point := from; point.Before(to); point = next(point) {
+		points[point.Unix()] = len(series)
+		series = append(series, UsageReportSeriesPoint{
+			From:     point.Unix(),
+			Products: UsageCounts{AdditionalProperties: map[string]int{}},
+		})
+	}
+
+	for _, hour := range instanceHours {
+		index, exists := points[truncate(hour.Hour.UTC()).Unix()]
+		if !exists {
+			continue
+		}
+
+		value, _ := series[index].Products.Get(hour.Product)
+		series[index].Products.Set(hour.Product, value+hour.Value)
+	}
+
+	return series
+}
+
+// mapUsageReportBreakdowns nests the counts by their first field.  Every breakdown requested is in the response, even
+// when no access logs were counted for it.
+func mapUsageReportBreakdowns(requested models.UsageReportBreakdowns, instanceBreakdowns []models.UsageReportInstanceBreakdown) *UsageReportBreakdowns {
+	response := UsageReportBreakdowns{}
+	if requested.Contains(models.UsageReportBreakdownDevice) {
+		response.Device = &UsageCounts{AdditionalProperties: map[string]int{}}
+	}
+	if requested.Contains(models.UsageReportBreakdownEndpoint) {
+		response.Endpoint = &NestedUsageCounts{AdditionalProperties: map[string]UsageCounts{}}
+	}
+	if requested.Contains(models.UsageReportBreakdownProductDevice) {
+		response.ProductDevice = &NestedUsageCounts{AdditionalProperties: map[string]UsageCounts{}}
+	}
+
+	addNested := func(counts *NestedUsageCounts, outer string, inner string, value int) {
+		if counts == nil {
+			return
+		}
+
+		nested, exists := counts.Get(outer)
+		if !exists {
+			nested = UsageCounts{AdditionalProperties: map[string]int{}}
+		}
+		nested.Set(inner, value)
+		counts.Set(outer, nested)
+	}
+
+	for _, breakdown := range instanceBreakdowns {
+		switch breakdown.Breakdown {
+		case models.UsageReportBreakdownDevice:
+			if response.Device != nil {
+				response.Device.Set(breakdown.AndroidId, breakdown.Value)
+			}
+		case models.UsageReportBreakdownEndpoint:
+			addNested(response.Endpoint, breakdown.Path, breakdown.Method, breakdown.Value)
+		case models.UsageReportBreakdownProductDevice:
+			addNested(response.ProductDevice, breakdown.Product, breakdown.AndroidId, breakdown.Value)
+		}
+	}
+
+	return &response
+}
+
 func (i Impl) GetSubscriptionsSubscriptionIdUsageReports(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string) error {
 	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
 	if err != nil {
@@ -168,13 +296,22 @@ func (i Impl) GetSubscriptionsSubscriptionIdUsageReports(ctx echo.Context, monit
 	return nil
 }
 
-func (i Impl) PatchSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, usageReportId string) error {
+func (i Impl) PatchSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, usageReportId string, params PatchSubscriptionsSubscriptionIdUsageReportsUsageReportIdParams) error {
 	usageReportUUID, err := uuid2.Parse(usageReportId)
 	if err != nil {
 		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
 		return nil
 	}
 
+	breakdowns := models.UsageReportBreakdowns{}
+	if params.Breakdowns != nil {
+		breakdowns, err = models.UsageReportBreakdownsFromString(*params.Breakdowns)
+		if err != nil {
+			noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+			return nil
+		}
+	}
+
 	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
 	if err != nil {
 		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
@@ -209,7 +346,7 @@ func (i Impl) PatchSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo
 		return nil
 	}
 
-	usageReportInstances, err := services.CheckUsageReportInstances(monitoringContext, usageReportUUID)
+	usageReportInstances, err := db.GetUsageReportInstances(monitoringContext, usageReportUUID)
 	if err != nil {
 		monitoringContext.Error("Unable to get Usage Report instances", zap.Error(err), zap.String("usageReportId", usageReportId))
 		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
@@ -217,13 +354,13 @@ func (i Impl) PatchSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo
 	}
 
 	for _, instance := range usageReportInstances {
-		if instance.CompletedAt == nil {
+		if instance.IsPending() {
 			jsonContentOrLog(monitoringContext, ctx, http.StatusOK, UsageReportState{State: "processing"})
 			return nil
 		}
 	}
 
-	err = services.CreateReportInstance(monitoringContext, usageReport)
+	err = services.CreateReportInstance(monitoringContext, usageReport, breakdowns)
 	if err != nil {
 		monitoringContext.Error("Could not create report instance",
 			zap.String("subscriptionId", subscriptionId), zap.Int("month", usageReport.Month),
@@ -236,6 +373,613 @@ func (i Impl) PatchSubscriptionsSubscriptionIdUsageReportsUsageReportId(ctx echo
 	return nil
 }
 
+func (i Impl) PostSubscriptionsSubscriptionIdUsageReportsUsageReportIdExports(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, usageReportId string, params PostSubscriptionsSubscriptionIdUsageReportsUsageReportIdExportsParams) error {
+	usageReportUUID, err := uuid2.Parse(usageReportId)
+	if err != nil {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
+	level := services.UsageExportLevelAggregate
+	if params.Level != nil {
+		level = *params.Level
+	}
+	if (params.Format != services.UsageExportFormatCsv && params.Format != services.UsageExportFormatJsonl) ||
+		(level != services.UsageExportLevelAggregate && level != services.UsageExportLevelRaw) {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
+	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	if apiAuth.Jwt == nil || apiAuth.Jwt.AccountId != subscription.AccountId.String() {
+		noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+		return nil
+	}
+
+	usageReportExists, usageReport, err := db.GetUsageReport(monitoringContext, usageReportUUID)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Usage Report exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !usageReportExists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	if usageReport.SubscriptionId != subscription.Id {
+		noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+		return nil
+	}
+
+	usageReportInstances, err := db.GetUsageReportInstances(monitoringContext, usageReportUUID)
+	if err != nil {
+		monitoringContext.Error("Unable to get Usage Report instances", zap.Error(err), zap.String("usageReportId", usageReportId))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	var newestCompletedInstance *models.UsageReportInstance
+	for _, instance := range usageReportInstances {
+		instancee := instance
+		if (newestCompletedInstance == nil || newestCompletedInstance.RequestedAt.Before(instance.RequestedAt)) && !utils.IsNil(instance.CompletedAt) {
+			newestCompletedInstance = &instancee
+		}
+	}
+
+	if newestCompletedInstance == nil {
+		noContentOrLog(monitoringContext, ctx, http.StatusConflict)
+		return nil
+	}
+
+	export, err := services.ExportUsageReportInstance(monitoringContext, usageReport, *newestCompletedInstance, params.Format, level)
+	if err != nil {
+		monitoringContext.Error("Could not export usage report", zap.String("usageReportId", usageReportId),
+			zap.String("format", params.Format), zap.String("level", level), zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	response, err := mapUsageReportExport(monitoringContext, export)
+	if err != nil {
+		monitoringContext.Error("Could not presign usage report export", zap.String("usageReportExportId", export.Id.String()),
+			zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	ctx.Response().Header().Set("Location", "/subscriptions/"+subscription.Id.String()+"/usage-reports/"+
+		usageReport.Id.String()+"/exports/"+export.Id.String())
+	jsonContentOrLog(monitoringContext, ctx, http.StatusCreated, response)
+	return nil
+}
+
+func (i Impl) GetSubscriptionsSubscriptionIdUsageReportsUsageReportIdExportsExportId(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, usageReportId string, exportId string) error {
+	usageReportUUID, err := uuid2.Parse(usageReportId)
+	if err != nil {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
+	exportUUID, err := uuid2.Parse(exportId)
+	if err != nil {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
+	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	if apiAuth.Jwt == nil || apiAuth.Jwt.AccountId != subscription.AccountId.String() {
+		noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+		return nil
+	}
+
+	exportExists, export, err := db.GetUsageReportExport(monitoringContext, exportUUID)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Usage Report Export exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exportExists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	usageReportExists, usageReport, err := db.GetUsageReportForInstance(monitoringContext, export.UsageReportInstanceId)
+	if err != nil {
+		monitoringContext.Error("Unable to get Usage Report for export", zap.Error(err), zap.String("usageReportExportId", exportId))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !usageReportExists || usageReport.Id != usageReportUUID || usageReport.SubscriptionId != subscription.Id {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	response, err := mapUsageReportExport(monitoringContext, export)
+	if err != nil {
+		monitoringContext.Error("Could not presign usage report export", zap.String("usageReportExportId", exportId),
+			zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	jsonContentOrLog(monitoringContext, ctx, http.StatusOK, response)
+	return nil
+}
+
+// mapUsageReportExport presigns a new URL for the export each time once it is ready, so the URL returned always has
+// the full expiry left
+func mapUsageReportExport(monitoringContext *monitoring.Context, export models.UsageReportExport) (UsageReportExport, error) {
+	response := UsageReportExport{
+		Id:     export.Id,
+		Format: export.Format,
+		Level:  export.Level,
+		State:  "processing",
+	}
+
+	switch {
+	case export.Status == models.UsageQueryCompleted:
+		download, err := services.PresignUsageReportExport(monitoringContext, export)
+		if err != nil {
+			return response, err
+		}
+
+		response.State = "ready"
+		response.Url = &download.Url
+		response.ExpiresAt = utils.Int64Ptr(download.ExpiresAt.Unix())
+	case export.IsFailed():
+		response.State = "failed"
+		response.FailureReason = export.FailureReason
+	}
+
+	return response, nil
+}
+
+// maxUsageQueryRange is a little over a year, so a leap year's usage can be asked for in one go
+const maxUsageQueryRange = 366 * 24 * time.Hour
+
+func (i Impl) PostSubscriptionsSubscriptionIdUsageQueries(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, request CreateUsageQueryRequest, subscriptionId string) error {
+	from := time.Unix(request.From, 0).UTC()
+	to := time.Unix(request.To, 0).UTC()
+	if !from.Before(to) || to.Sub(from) > maxUsageQueryRange {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
+	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	if !canQueryUsage(apiAuth, subscription) {
+		noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+		return nil
+	}
+
+	usageQuery, err := services.CreateUsageQuery(monitoringContext, subscription.Id, from, to)
+	if err != nil {
+		monitoringContext.Error("Could not create usage query", zap.String("subscriptionId", subscriptionId),
+			zap.Int64("from", request.From), zap.Int64("to", request.To), zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	ctx.Response().Header().Set("Location", "/subscriptions/"+subscription.Id.String()+"/usage-queries/"+usageQuery.Id.String())
+	jsonContentOrLog(monitoringContext, ctx, http.StatusCreated, mapUsageQuery(usageQuery, nil))
+	return nil
+}
+
+func (i Impl) GetSubscriptionsSubscriptionIdUsageQueriesUsageQueryId(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, usageQueryId string) error {
+	usageQueryUUID, err := uuid2.Parse(usageQueryId)
+	if err != nil {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
+	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	if !canQueryUsage(apiAuth, subscription) {
+		noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+		return nil
+	}
+
+	usageQueryExists, usageQuery, err := db.GetUsageQuery(monitoringContext, usageQueryUUID)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Usage Query exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !usageQueryExists || usageQuery.SubscriptionId != subscription.Id {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	var products []models.UsageQueryProduct
+	if usageQuery.Status == models.UsageQueryCompleted {
+		products, err = db.GetUsageQueryProducts(monitoringContext, usageQuery.Id)
+		if err != nil {
+			monitoringContext.Error("Unable to get Usage Query products", zap.Error(err), zap.String("usageQueryId", usageQueryId))
+			noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+			return nil
+		}
+	}
+
+	jsonContentOrLog(monitoringContext, ctx, http.StatusOK, mapUsageQuery(usageQuery, products))
+	return nil
+}
+
+// canQueryUsage allows API keys with the query-usage permission, which the generated wrapper has already checked, and
+// users of the Subscription's account
+func canQueryUsage(apiAuth ApiAuth, subscription models.Subscription) bool {
+	return apiAuth.ApiKey != nil || (apiAuth.Jwt != nil && apiAuth.Jwt.AccountId == subscription.AccountId.String())
+}
+
+func mapUsageQuery(usageQuery models.UsageQuery, products []models.UsageQueryProduct) UsageQuery {
+	response := UsageQuery{
+		Id:    usageQuery.Id,
+		From:  usageQuery.StartsAt.Unix(),
+		To:    usageQuery.EndsAt.Unix(),
+		State: "processing",
+	}
+
+	switch {
+	case usageQuery.Status == models.UsageQueryCompleted:
+		response.State = "ready"
+		response.CompletedAt = utils.Int64Ptr(usageQuery.CompletedAt.Unix())
+		counts := UsageCounts{AdditionalProperties: map[string]int{}}
+		for _, product := range products {
+			counts.AdditionalProperties[product.Product] = product.Value
+		}
+		response.Products = &counts
+	case usageQuery.IsFailed():
+		response.State = "failed"
+		response.FailureReason = usageQuery.FailureReason
+	}
+
+	return response
+}
+
+func (i Impl) GetSubscriptionsSubscriptionIdCompactions(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, params GetSubscriptionsSubscriptionIdCompactionsParams) error {
+	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	from := utils.ToDay(subscription.CreatedAt.UTC())
+	if params.From != nil {
+		from = time.Unix(*params.From, 0).UTC()
+	}
+
+	to := time.Now().UTC()
+	if params.To != nil {
+		to = time.Unix(*params.To, 0).UTC()
+	}
+
+	compactionDays, err := db.GetCompactionDays(monitoringContext, subscription.Id, from, to)
+	if err != nil {
+		monitoringContext.Error("Unable to get compaction ledger", zap.Error(err), zap.String("subscriptionId", subscriptionId))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	response := make([]CompactionDay, len(compactionDays))
+	for i, compactionDay := range compactionDays {
+		response[i] = CompactionDay{
+			Day:                   compactionDay.Day.Unix(),
+			Status:                string(compactionDay.Status),
+			SourceObjectCount:     compactionDay.SourceObjectCount,
+			RecordCount:           compactionDay.RecordCount,
+			OutputKey:             compactionDay.OutputKey,
+			SourceBytes:           compactionDay.SourceBytes,
+			OutputBytes:           compactionDay.OutputBytes,
+			ContentSha256:         compactionDay.ContentSha256,
+			DuplicateCount:        compactionDay.DuplicateCount,
+			DeadLetterCount:       compactionDay.DeadLetterCount,
+			UnreadableObjectCount: compactionDay.UnreadableObjectCount,
+			Attempts:              compactionDay.Attempts,
+			LastError:             compactionDay.LastError,
+			UpdatedAt:             compactionDay.UpdatedAt.Unix(),
+		}
+	}
+
+	jsonContentOrLog(monitoringContext, ctx, http.StatusOK, response)
+	return nil
+}
+
+func (i Impl) GetSubscriptionsSubscriptionIdCompactionsMonths(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, subscriptionId string, params GetSubscriptionsSubscriptionIdCompactionsMonthsParams) error {
+	exists, subscription, err := db.GetSubscriptionById(monitoringContext, subscriptionId)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	from := utils.ToMonth(subscription.CreatedAt.UTC())
+	if params.From != nil {
+		from = utils.ToMonth(time.Unix(*params.From, 0).UTC())
+	}
+
+	to := time.Now().UTC()
+	if params.To != nil {
+		to = time.Unix(*params.To, 0).UTC()
+	}
+
+	compactionMonths, err := db.GetCompactionMonths(monitoringContext, subscription.Id, from, to)
+	if err != nil {
+		monitoringContext.Error("Unable to get monthly roll-up ledger", zap.Error(err), zap.String("subscriptionId", subscriptionId))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	response := make([]CompactionMonth, len(compactionMonths))
+	for i, compactionMonth := range compactionMonths {
+		response[i] = CompactionMonth{
+			Month:                 compactionMonth.Month.Unix(),
+			Status:                string(compactionMonth.Status),
+			SourceObjectCount:     compactionMonth.SourceObjectCount,
+			RecordCount:           compactionMonth.RecordCount,
+			PartCount:             compactionMonth.PartCount,
+			OutputPrefix:          compactionMonth.OutputPrefix,
+			SourceBytes:           compactionMonth.SourceBytes,
+			OutputBytes:           compactionMonth.OutputBytes,
+			DuplicateCount:        compactionMonth.DuplicateCount,
+			DeadLetterCount:       compactionMonth.DeadLetterCount,
+			UnreadableObjectCount: compactionMonth.UnreadableObjectCount,
+			Attempts:              compactionMonth.Attempts,
+			LastError:             compactionMonth.LastError,
+			UpdatedAt:             compactionMonth.UpdatedAt.Unix(),
+		}
+	}
+
+	jsonContentOrLog(monitoringContext, ctx, http.StatusOK, response)
+	return nil
+}
+
+func (i Impl) GetCronJobs(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth) error {
+	latestRuns, err := db.GetLatestCronJobRuns(monitoringContext)
+	if err != nil {
+		monitoringContext.Error("Unable to get latest cron job runs", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	latestRunsByName := make(map[string]models.CronJobRun, len(latestRuns))
+	for _, run := range latestRuns {
+		latestRunsByName[run.Name] = run
+	}
+
+	jobs := cron.GetJobs()
+	response := make([]CronJob, len(jobs))
+	for i, job := range jobs {
+		response[i] = CronJob{
+			Name:             job.Name,
+			LockLeaseSeconds: int64(job.GetLockLease().Seconds()),
+			TimeoutSeconds:   int64(job.Timeout.Seconds()),
+		}
+
+		if schedule := config.GetConfig().CronConfig.Schedules[job.Name]; schedule != "" {
+			response[i].Schedule = &schedule
+		}
+
+		if run, exists := latestRunsByName[job.Name]; exists {
+			lastRun := mapCronJobRun(run)
+			response[i].LastRun = &lastRun
+		}
+	}
+
+	jsonContentOrLog(monitoringContext, ctx, http.StatusOK, response)
+	return nil
+}
+
+func (i Impl) GetCronJobsCronJobNameRuns(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, cronJobName string, params GetCronJobsCronJobNameRunsParams) error {
+	if _, exists := cron.GetJob(cronJobName); !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	limit := 20
+	if params.Limit != nil {
+		limit = *params.Limit
+	}
+
+	if limit < 1 {
+		noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+		return nil
+	}
+
+	runs, err := db.GetCronJobRuns(monitoringContext, cronJobName, limit)
+	if err != nil {
+		monitoringContext.Error("Unable to get cron job runs", zap.Error(err), zap.String("cronName", cronJobName))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	response := make([]CronJobRun, len(runs))
+	for i, run := range runs {
+		response[i] = mapCronJobRun(run)
+	}
+
+	jsonContentOrLog(monitoringContext, ctx, http.StatusOK, response)
+	return nil
+}
+
+func (i Impl) PostCronJobsCronJobNameRuns(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, cronJobName string, params PostCronJobsCronJobNameRunsParams) error {
+	job, exists := cron.GetJob(cronJobName)
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	parameters := url.Values{}
+	if params.DryRun != nil && *params.DryRun {
+		parameters.Set("dryRun", "true")
+	}
+
+	run, started, err := cron.TriggerJob(job, parameters)
+	if err == cron.ErrShuttingDown {
+		noContentOrLog(monitoringContext, ctx, http.StatusServiceUnavailable)
+		return nil
+	}
+
+	if err != nil {
+		monitoringContext.Error("Unable to trigger cron job", zap.Error(err), zap.String("cronName", cronJobName))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !started {
+		noContentOrLog(monitoringContext, ctx, http.StatusConflict)
+		return nil
+	}
+
+	jsonContentOrLog(monitoringContext, ctx, http.StatusAccepted, mapCronJobRun(run))
+	return nil
+}
+
+func mapCronJobRun(run models.CronJobRun) CronJobRun {
+	response := CronJobRun{
+		Id:        run.Id,
+		Name:      run.Name,
+		Host:      run.Host,
+		Trigger:   string(run.Trigger),
+		Status:    string(run.Status),
+		StartedAt: run.StartedAt.Unix(),
+		Error:     run.Error,
+		Summary:   CronJobRun_Summary{AdditionalProperties: run.Summary},
+	}
+
+	if run.EndedAt != nil {
+		response.EndedAt = utils.Int64Ptr(run.EndedAt.Unix())
+	}
+
+	return response
+}
+
+func (i Impl) PostLogAction(ctx echo.Context, monitoringContext *monitoring.Context, apiAuth ApiAuth, request LogActionRequest) error {
+	if apiAuth.Jwt == nil {
+		noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+		return nil
+	}
+
+	exists, subscription, err := db.GetSubscriptionById(monitoringContext, apiAuth.Jwt.SubscriptionId)
+	if err != nil {
+		monitoringContext.Error("Unable to check if Subscription exists", zap.Error(err))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	if !exists {
+		noContentOrLog(monitoringContext, ctx, http.StatusNotFound)
+		return nil
+	}
+
+	if subscription.State != models.Active {
+		noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+		return nil
+	}
+
+	records := make([]models.AccessLogRecord, len(request.Events))
+	for i, event := range request.Events {
+		if event.SubscriptionId != subscription.Id.String() {
+			noContentOrLog(monitoringContext, ctx, http.StatusForbidden)
+			return nil
+		}
+
+		id, err := uuid2.Parse(event.Id)
+		if err != nil {
+			noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+			return nil
+		}
+
+		records[i] = models.AccessLogRecord{
+			Id:             id,
+			OccurredAt:     event.OccurredAt,
+			Product:        event.Product,
+			Method:         event.Method,
+			Path:           event.Path,
+			AndroidId:      event.AndroidId,
+			SubscriptionId: subscription.Id,
+		}
+
+		if err := ingestion.ValidateAccessLogRecord(records[i], subscription.Id); err != nil {
+			monitoringContext.Info("Rejecting invalid access log event", zap.Error(err))
+			noContentOrLog(monitoringContext, ctx, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	err = ingestion.BufferAccessLogs(monitoringContext, subscription.Id, records)
+	if err == ingestion.ErrBufferFull {
+		noContentOrLog(monitoringContext, ctx, http.StatusServiceUnavailable)
+		return nil
+	}
+
+	if err != nil {
+		monitoringContext.Error("Unable to write access log events",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()))
+		noContentOrLog(monitoringContext, ctx, http.StatusInternalServerError)
+		return nil
+	}
+
+	noContentOrLog(monitoringContext, ctx, http.StatusAccepted)
+	return nil
+}
+
 func (Impl) GetHealthcheck(ctx echo.Context, monitoringContext *monitoring.Context) error {
 	healthcheck, err := db.Healthcheck()
 	if err != nil || !healthcheck {
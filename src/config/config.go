@@ -14,19 +14,26 @@ var activeConfig *config
 var activeProfile *string
 
 type config struct {
-	Server         serverConfig
-	Logging        loggingConfig
-	Database       databaseConfig
-	NewRelicConfig newRelicConfig
-	AuthConfig     authConfig
-	AwsConfig      awsConfig
-	BucketConfig   bucketConfig
-	AthenaConfig   athenaConfig
-	Testing        bool
+	Server           serverConfig
+	Logging          loggingConfig
+	Database         databaseConfig
+	NewRelicConfig   newRelicConfig
+	AuthConfig       authConfig
+	AwsConfig        awsConfig
+	BucketConfig     bucketConfig
+	AthenaConfig     athenaConfig
+	CompactionConfig compactionConfig
+	CronConfig       cronConfig
+	StorageConfig    storageConfig
+	UsageQueryConfig usageQueryConfig
+	Testing          bool
 }
 
 type serverConfig struct {
 	Port int
+	// ShutdownTimeoutSeconds is how long in-flight requests and cron jobs are given to finish once the pod is told to
+	// stop, so it should be less than the pod's termination grace period
+	ShutdownTimeoutSeconds int
 }
 
 type loggingConfig struct {
@@ -63,7 +70,75 @@ type awsConfig struct {
 }
 
 type bucketConfig struct {
-	AccessLogBucket string
+	AccessLogBucket       string
+	BufferMaxEvents       int
+	BufferMaxBytes        int
+	BufferFlushIntervalMs int
+	// BufferMaxHeldBytes caps what the buffered writer holds while retrying failed writes, records past it are
+	// rejected.  It defaults to ten times BufferMaxBytes.
+	BufferMaxHeldBytes int
+	DeadLetterPrefix   string
+	CompactedFormat    string
+	ParquetPrefix      string
+}
+
+// The formats compacted access logs can be written in, selected by BucketConfig.CompactedFormat.  Parquet files are
+// written alongside the gzipped JSON under ParquetPrefix and the usage report tables read from there for the days
+// which have been compacted.
+const (
+	CompactedFormatJson    = "json"
+	CompactedFormatParquet = "parquet"
+)
+
+func (c bucketConfig) IsParquetEnabled() bool {
+	return c.CompactedFormat == CompactedFormatParquet
+}
+
+// storageConfig selects where objects are kept.  The filesystem backend keeps each bucket as a directory under
+// FilesystemRoot, so that it can be run without S3.
+type storageConfig struct {
+	Backend        string
+	FilesystemRoot string
+}
+
+const (
+	StorageBackendS3         = "s3"
+	StorageBackendFilesystem = "filesystem"
+)
+
+// usageQueryConfig selects what counts the access logs for usage reports.  The local backend scans the objects in
+// this process, so gives real numbers without Athena but is only suited to small deployments.
+type usageQueryConfig struct {
+	Backend string
+	// PollIntervalSeconds is how often pending usage report instances are checked for results
+	PollIntervalSeconds int
+	// MaxAttempts is how many queries are started for a usage report instance before it is marked failed
+	MaxAttempts int
+	// RetryBackoffSeconds is the wait before the first retry, doubling for each one after
+	RetryBackoffSeconds int
+	// ExportUrlExpirySeconds is how long the download URL returned for a usage report export works for
+	ExportUrlExpirySeconds int
+}
+
+const (
+	UsageQueryBackendAthena = "athena"
+	UsageQueryBackendLocal  = "local"
+)
+
+// cronConfig holds the cron expression for each job by name, a job without one is never scheduled.  A job's lock is
+// held for its lease at a time and renewed while the job runs, so a job on a pod that dies can be run again once it
+// runs out.  LockTtlSeconds is the lease for jobs which do not set their own.
+type cronConfig struct {
+	Schedules      map[string]string
+	LockTtlSeconds int
+}
+
+type compactionConfig struct {
+	Workers            int
+	VerifyBeforeDelete bool
+	DryRun             bool
+	DedupWindowDays    int
+	MonthPartMaxBytes  int
 }
 
 type athenaConfig struct {
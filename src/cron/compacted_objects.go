@@ -0,0 +1,296 @@
+package cron
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	uuid2 "github.com/google/uuid"
+	"go.uber.org/zap"
+	"hash"
+	"io"
+	"subscriptions/src/ingestion"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+)
+
+// countingWriter counts the bytes written through it, and the number of non-empty lines
+type countingWriter struct {
+	writer   io.Writer
+	bytes    int64
+	lines    int64
+	lastByte byte
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	for _, b := range p[:n] {
+		if b == '\n' && w.lastByte != '\n' {
+			w.lines++
+		}
+		w.lastByte = b
+	}
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+type compactedObjectCounts struct {
+	lines  int64
+	bytes  int64
+	sha256 string
+}
+
+// compactedObject is a day object or month part which has been uploaded
+type compactedObject struct {
+	key    string
+	counts compactedObjectCounts
+}
+
+// objectUpload streams everything written to it through a single gzip writer straight into a multipart upload, so the
+// memory used is bounded by the upload part size rather than the size of the object.
+type objectUpload struct {
+	key          string
+	pipeWriter   *io.PipeWriter
+	zipWriter    *gzip.Writer
+	compressed   *countingWriter
+	uncompressed *countingWriter
+	checksum     hash.Hash
+	result       chan error
+}
+
+// streamUpload returns a writer whose contents are streamed into a multipart upload to key, and a channel that
+// receives the result of the upload once the writer is closed.
+func streamUpload(monitoringContext *monitoring.Context, key string) (*io.PipeWriter, chan error) {
+	pipeReader, pipeWriter := io.Pipe()
+	result := make(chan error, 1)
+
+	go func() {
+		err := storage.AccessLogs.PutMultipart(monitoringContext, key, pipeReader)
+
+		// Unblocks the writer if the upload gave up part way through
+		pipeReader.CloseWithError(err)
+		result <- err
+	}()
+
+	return pipeWriter, result
+}
+
+func startObjectUpload(monitoringContext *monitoring.Context, key string) (*objectUpload, error) {
+	pipeWriter, result := streamUpload(monitoringContext, key)
+	compressed := &countingWriter{writer: pipeWriter}
+
+	zipWriter, err := gzip.NewWriterLevel(compressed, 9)
+	if err != nil {
+		pipeWriter.CloseWithError(err)
+		<-result
+		return nil, err
+	}
+
+	checksum := sha256.New()
+	upload := &objectUpload{
+		key:          key,
+		pipeWriter:   pipeWriter,
+		zipWriter:    zipWriter,
+		compressed:   compressed,
+		uncompressed: &countingWriter{writer: io.MultiWriter(zipWriter, checksum)},
+		checksum:     checksum,
+		result:       result,
+	}
+
+	return upload, nil
+}
+
+func (u *objectUpload) Write(p []byte) (int, error) {
+	return u.uncompressed.Write(p)
+}
+
+// finish flushes the gzip writer and waits for the upload to complete
+func (u *objectUpload) finish() (compactedObject, error) {
+	if err := u.zipWriter.Close(); err != nil {
+		u.abort(err)
+		return compactedObject{}, err
+	}
+
+	u.pipeWriter.Close()
+	if err := <-u.result; err != nil {
+		return compactedObject{}, err
+	}
+
+	return compactedObject{
+		key: u.key,
+		counts: compactedObjectCounts{
+			lines:  u.uncompressed.lines,
+			bytes:  u.compressed.bytes,
+			sha256: hex.EncodeToString(u.checksum.Sum(nil)),
+		},
+	}, nil
+}
+
+// abort fails the upload so that nothing is left behind in the bucket
+func (u *objectUpload) abort(cause error) {
+	u.pipeWriter.CloseWithError(cause)
+	<-u.result
+}
+
+// recordMerge tracks the records seen while merging objects together, and the ones which were left out
+type recordMerge struct {
+	subscriptionId    uuid2.UUID
+	seenIds           map[uuid2.UUID]struct{}
+	duplicates        int64
+	deadLetters       []deadLetter
+	unreadableObjects []unreadableObject
+}
+
+func newRecordMerge(subscriptionId uuid2.UUID, seenIds map[uuid2.UUID]struct{}) *recordMerge {
+	if seenIds == nil {
+		seenIds = make(map[uuid2.UUID]struct{})
+	}
+
+	return &recordMerge{subscriptionId: subscriptionId, seenIds: seenIds}
+}
+
+// mergeObject writes each valid record in the object on its own line, skipping any whose Id has already been seen.
+// Each line is given to the writer in a single call.  The whole object is un-gzipped before anything is written, so
+// a corrupt object is set aside rather than being partly compacted.
+func mergeObject(monitoringContext *monitoring.Context, writer io.Writer, key string, merge *recordMerge) error {
+	var lines [][]byte
+	err := forEachLine(monitoringContext, key, func(line []byte) error {
+		lines = append(lines, line)
+		return nil
+	})
+
+	var unreadable *unreadableObjectError
+	if errors.As(err, &unreadable) {
+		merge.unreadableObjects = append(merge.unreadableObjects, unreadableObject{key: key, reason: unreadable.Error()})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		var record models.AccessLogRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			merge.deadLetters = append(merge.deadLetters, deadLetter{SourceKey: key, Reason: err.Error(), Line: string(line)})
+			continue
+		}
+
+		if err := ingestion.ValidateAccessLogRecord(record, merge.subscriptionId); err != nil {
+			merge.deadLetters = append(merge.deadLetters, deadLetter{SourceKey: key, Reason: err.Error(), Line: string(line)})
+			continue
+		}
+
+		if _, seen := merge.seenIds[record.Id]; seen {
+			merge.duplicates++
+			continue
+		}
+		merge.seenIds[record.Id] = struct{}{}
+
+		if _, err := writer.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unreadableObjectError is returned by forEachLine when the object was fetched but is not valid gzip
+type unreadableObjectError struct {
+	cause error
+}
+
+func (e *unreadableObjectError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *unreadableObjectError) Unwrap() error {
+	return e.cause
+}
+
+// forEachLine un-gzips the object and calls action with each non-empty line, without its line ending
+func forEachLine(monitoringContext *monitoring.Context, key string, action func(line []byte) error) error {
+	object, err := storage.AccessLogs.Get(monitoringContext, key)
+	if err != nil {
+		return fmt.Errorf("could not get object %s: %w", key, err)
+	}
+	defer object.Close()
+
+	gz, err := gzip.NewReader(object)
+	if err != nil {
+		return &unreadableObjectError{cause: fmt.Errorf("could not create gzip reader for object %s: %w", key, err)}
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return &unreadableObjectError{cause: fmt.Errorf("could not un-gzip object %s: %w", key, readErr)}
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			if err := action(line); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// verifyCompactedObject reads the uploaded object back and checks it has the same number of records and the same
+// content as was written to it.
+func verifyCompactedObject(monitoringContext *monitoring.Context, object compactedObject) error {
+	response, err := storage.AccessLogs.Get(monitoringContext, object.key)
+	if err != nil {
+		return fmt.Errorf("could not get compacted object %s to verify it: %w", object.key, err)
+	}
+	defer response.Close()
+
+	gz, err := gzip.NewReader(response)
+	if err != nil {
+		return fmt.Errorf("could not create gzip reader to verify compacted object %s: %w", object.key, err)
+	}
+	defer gz.Close()
+
+	checksum := sha256.New()
+	uncompressed := &countingWriter{writer: checksum}
+	if _, err := io.Copy(uncompressed, gz); err != nil {
+		return fmt.Errorf("could not un-gzip compacted object %s to verify it: %w", object.key, err)
+	}
+
+	if uncompressed.lines != object.counts.lines {
+		return fmt.Errorf("compacted object %s has %d records but %d were compacted",
+			object.key, uncompressed.lines, object.counts.lines)
+	}
+
+	if actual := hex.EncodeToString(checksum.Sum(nil)); actual != object.counts.sha256 {
+		return fmt.Errorf("compacted object %s has checksum %s but %s was compacted",
+			object.key, actual, object.counts.sha256)
+	}
+
+	return nil
+}
+
+// removeCompactedObject deletes a compacted object whose sources are being kept, otherwise the next run would see it
+// and delete the sources without compacting them again.
+func removeCompactedObject(monitoringContext *monitoring.Context, key string) {
+	err := storage.AccessLogs.Delete(checkpointContext(monitoringContext), key)
+	if err != nil {
+		monitoringContext.Error("Could not remove compacted object whose sources are being kept",
+			zap.Error(err), zap.String("key", key))
+	}
+}
+
+func deleteObject(monitoringContext *monitoring.Context, key string) error {
+	return storage.AccessLogs.Delete(monitoringContext, key)
+}
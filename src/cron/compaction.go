@@ -0,0 +1,479 @@
+package cron
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	uuid2 "github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/url"
+	"strings"
+	"subscriptions/src/config"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+	"subscriptions/src/utils"
+	"sync"
+	"time"
+)
+
+const subscriptionsPageSize = 50
+
+// compactionSummary totals the days or months compacted across every Subscription in a run
+type compactionSummary struct {
+	mutex         sync.Mutex
+	subscriptions int
+	succeeded     int
+	failed        int
+	compacted     int
+	duplicates    int64
+}
+
+type subscriptionCompaction struct {
+	compacted  int
+	duplicates int64
+}
+
+func (s *compactionSummary) record(compaction subscriptionCompaction, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.subscriptions++
+	s.compacted += compaction.compacted
+	s.duplicates += compaction.duplicates
+	if err != nil {
+		s.failed++
+	} else {
+		s.succeeded++
+	}
+}
+
+// runSummary gives the counts to record against the cron job run, with the name to use for what was compacted, and
+// fails the run if any Subscription failed
+func (s *compactionSummary) runSummary(compactedName string) (models.CronJobRunSummary, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	summary := models.CronJobRunSummary{
+		"subscriptions": int64(s.subscriptions),
+		"succeeded":     int64(s.succeeded),
+		"failed":        int64(s.failed),
+		compactedName:   int64(s.compacted),
+		"duplicates":    s.duplicates,
+	}
+
+	if s.failed > 0 {
+		return summary, fmt.Errorf("%d of %d Subscriptions failed", s.failed, s.subscriptions)
+	}
+
+	return summary, nil
+}
+
+type compactionOptions struct {
+	// lock is the lease of the job doing the compaction, which fences the writes to the ledger
+	lock               models.CronLock
+	dryRun             bool
+	verifyBeforeDelete bool
+	dedupWindowDays    int
+	monthPartMaxBytes  int64
+}
+
+// compactionOptionsFromParameters takes the options from config, allowing a forced run to ask for a dry run
+func compactionOptionsFromParameters(lock models.CronLock, parameters url.Values) compactionOptions {
+	options := compactionOptions{
+		lock:               lock,
+		dryRun:             config.GetConfig().CompactionConfig.DryRun,
+		verifyBeforeDelete: config.GetConfig().CompactionConfig.VerifyBeforeDelete,
+		dedupWindowDays:    config.GetConfig().CompactionConfig.DedupWindowDays,
+		monthPartMaxBytes:  int64(config.GetConfig().CompactionConfig.MonthPartMaxBytes),
+	}
+
+	if parameters.Get("dryRun") == "true" {
+		options.dryRun = true
+	}
+
+	return options
+}
+
+type smallObject struct {
+	key  string
+	size int64
+}
+
+func init() {
+	registerJob(Job{
+		Name:      "access-log-compaction",
+		Timeout:   20 * time.Hour,
+		LockLease: 10 * time.Minute,
+		Run: func(monitoringContext *monitoring.Context, lock models.CronLock, parameters url.Values) (models.CronJobRunSummary, error) {
+			return compact(monitoringContext, compactionOptionsFromParameters(lock, parameters))
+		},
+	})
+}
+
+// compact compacts the days of every Subscription
+func compact(monitoringContext *monitoring.Context, options compactionOptions) (models.CronJobRunSummary, error) {
+	summary := &compactionSummary{}
+	forEachSubscription(monitoringContext, func(subscription models.Subscription) {
+		summary.record(processSubscription(monitoringContext, subscription, options))
+	})
+
+	monitoringContext.Info("Finished s3 compaction",
+		zap.Bool("dryRun", options.dryRun),
+		zap.Int("subscriptions", summary.subscriptions),
+		zap.Int("succeeded", summary.succeeded),
+		zap.Int("failed", summary.failed),
+		zap.Int("daysCompacted", summary.compacted),
+		zap.Int64("duplicates", summary.duplicates))
+
+	return summary.runSummary("daysCompacted")
+}
+
+// forEachSubscription pages through every Subscription in id order, handing them to a fixed size pool of workers.  It
+// only returns once every worker has finished so the cron lock is held for the whole run.  No more Subscriptions are
+// handed out once the context is done.
+func forEachSubscription(monitoringContext *monitoring.Context, action func(subscription models.Subscription)) {
+	subscriptions := make(chan models.Subscription)
+
+	workerCount := config.GetConfig().CompactionConfig.Workers
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for subscription := range subscriptions {
+				action(subscription)
+			}
+		}()
+	}
+
+	afterId := uuid2.Nil
+	for monitoringContext.Err() == nil {
+		page, err := db.GetSubscriptionsPageAfter(monitoringContext, subscriptionsPageSize, afterId)
+		if err != nil {
+			monitoringContext.Error("Could not get page of Subscriptions when attempting to compact",
+				zap.Error(err), zap.String("afterId", afterId.String()))
+			break
+		}
+
+		for _, subscription := range page {
+			select {
+			case subscriptions <- subscription:
+			case <-monitoringContext.Done():
+			}
+		}
+
+		if len(page) < subscriptionsPageSize {
+			break
+		}
+
+		afterId = page[len(page)-1].Id
+	}
+
+	close(subscriptions)
+	workers.Wait()
+}
+
+// processSubscription compacts every day from the Subscription's creation up to yesterday that the compaction ledger
+// does not already have as succeeded.  A failed day is recorded and the remaining days are still attempted.
+func processSubscription(monitoringContext *monitoring.Context, subscription models.Subscription, options compactionOptions) (compaction subscriptionCompaction, err error) {
+	monitoringContext.Info("Starting s3 compact", zap.String("subscriptionId", subscription.Id.String()))
+
+	currentDay := utils.ToDay(subscription.CreatedAt.UTC())
+	end := utils.ToDay(time.Now().UTC())
+
+	ledger, err := db.GetCompactionDays(monitoringContext, subscription.Id, currentDay, end)
+	if err != nil {
+		monitoringContext.Error("Could not get compaction ledger",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()))
+		return compaction, err
+	}
+
+	ledgerByDay := make(map[string]models.CompactionDay, len(ledger))
+	for _, compactionDay := range ledger {
+		ledgerByDay[compactionDay.Day.Format("2006-01-02")] = compactionDay
+	}
+
+	var firstErr error
+	for ; currentDay.Before(end); currentDay = currentDay.Add(time.Hour * 24) {
+		// Stop between days once the run has been cancelled, rather than failing each remaining day
+		if err := monitoringContext.Err(); err != nil {
+			return compaction, err
+		}
+
+		compactionDay, exists := ledgerByDay[currentDay.Format("2006-01-02")]
+		if exists && compactionDay.Status == models.CompactionSucceeded {
+			continue
+		}
+
+		if !exists {
+			compactionDay = models.CompactionDay{SubscriptionId: subscription.Id, Day: currentDay}
+		}
+
+		monitoringContext.Info("Starting s3 compact day", zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", currentDay))
+		duplicates, err := processSubscriptionDay(monitoringContext, subscription, compactionDay, options)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		monitoringContext.Info("Finished s3 compact day", zap.String("subscriptionId", subscription.Id.String()),
+			zap.Time("day", currentDay), zap.Int64("duplicates", duplicates))
+
+		compaction.compacted++
+		compaction.duplicates += duplicates
+	}
+
+	return compaction, firstErr
+}
+
+// processSubscriptionDay compacts the small objects for a single day into the day object, and returns how many
+// duplicate records were dropped while doing so.  Small objects listed once the day object exists, because they
+// arrived late or an earlier attempt stopped before deleting its sources, are compacted into another day object
+// rather than the existing one being rewritten.  Either way the sources are only deleted once the object they were
+// merged into has been written and verified.
+func processSubscriptionDay(monitoringContext *monitoring.Context, subscription models.Subscription, compactionDay models.CompactionDay, options compactionOptions) (int64, error) {
+	day := compactionDay.Day
+	dayPrefix := getDayPrefix(subscription, day)
+	compactionDay.Attempts++
+
+	smallObjects, dayObjectKeys, err := listDayObjects(monitoringContext, subscription, day)
+	if err != nil {
+		monitoringContext.Error("Could not list objects when attempting to compact into day "+
+			"object for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+		recordDayFailure(monitoringContext, options.lock, compactionDay, models.CompactionFailed, err)
+		return 0, err
+	}
+
+	dayKey := dayPrefix + "/day.gz"
+	if len(dayObjectKeys) > 0 {
+		dayKey = fmt.Sprintf("%s/day-%d.gz", dayPrefix, time.Now().UnixNano())
+	}
+
+	if options.dryRun {
+		reportDryRun(monitoringContext, subscription, day, dayKey, len(dayObjectKeys) > 0, smallObjects)
+		return 0, nil
+	}
+
+	if len(smallObjects) > 0 {
+		seenIds, err := getIdsCompactedInWindow(monitoringContext, subscription, day, options.dedupWindowDays)
+		if err == nil {
+			// Records from sources an earlier attempt compacted but did not get to delete are already in the day
+			err = addCompactedIds(monitoringContext, seenIds, dayObjectKeys)
+		}
+		if err != nil {
+			monitoringContext.Error("Unable to read previous day objects to deduplicate against",
+				zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+			recordDayFailure(monitoringContext, options.lock, compactionDay, models.CompactionFailed, err)
+			return 0, err
+		}
+
+		merge := newRecordMerge(subscription.Id, seenIds)
+		dayObject, err := writeDayObject(monitoringContext, dayKey, smallObjects, merge)
+		if err != nil {
+			monitoringContext.Error("Unable to write day object",
+				zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+			recordDayFailure(monitoringContext, options.lock, compactionDay, models.CompactionFailed, err)
+			return 0, err
+		}
+
+		if options.verifyBeforeDelete {
+			if err := verifyCompactedObject(monitoringContext, dayObject); err != nil {
+				monitoringContext.Error("Day object failed verification, keeping the small objects",
+					zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+				removeCompactedObject(monitoringContext, dayKey)
+				recordDayFailure(monitoringContext, options.lock, compactionDay, models.CompactionVerificationFailed, err)
+				return 0, err
+			}
+		}
+
+		if config.GetConfig().BucketConfig.IsParquetEnabled() {
+			if _, err := writeParquetCopy(monitoringContext, dayObject); err != nil {
+				monitoringContext.Error("Unable to write Parquet copy of day object, keeping the small objects",
+					zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+				removeCompactedObject(monitoringContext, dayKey)
+				recordDayFailure(monitoringContext, options.lock, compactionDay, models.CompactionFailed, err)
+				return 0, err
+			}
+		}
+
+		// The sources are about to be deleted so the dead letters must be safely written first, otherwise the day
+		// object is removed so the whole day is attempted again
+		if err := writeDeadLetters(monitoringContext, dayPrefix, merge); err != nil {
+			monitoringContext.Error("Unable to write dead letters, keeping the small objects",
+				zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+			removeCompactedObject(monitoringContext, dayKey)
+			recordDayFailure(monitoringContext, options.lock, compactionDay, models.CompactionFailed, err)
+			return 0, err
+		}
+		if len(merge.deadLetters) > 0 || len(merge.unreadableObjects) > 0 {
+			monitoringContext.Warn("Routed invalid access log records to dead-letter prefix",
+				zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day),
+				zap.Int("deadLetters", len(merge.deadLetters)), zap.Int("unreadableObjects", len(merge.unreadableObjects)))
+		}
+
+		compactionDay.SourceObjectCount = len(smallObjects)
+		compactionDay.SourceBytes = 0
+		for _, object := range smallObjects {
+			compactionDay.SourceBytes += object.size
+		}
+		compactionDay.RecordCount = dayObject.counts.lines
+		compactionDay.OutputKey = &dayKey
+		compactionDay.OutputBytes = dayObject.counts.bytes
+		compactionDay.ContentSha256 = &dayObject.counts.sha256
+		compactionDay.DuplicateCount = merge.duplicates
+		compactionDay.DeadLetterCount = int64(len(merge.deadLetters))
+		compactionDay.UnreadableObjectCount = len(merge.unreadableObjects)
+
+		// Only the objects merged into the object verified above are deleted, so nothing is removed which was not
+		// compacted.  Anything which arrived while compacting is left for the monthly roll up.
+		for _, object := range smallObjects {
+			if err := deleteObject(monitoringContext, object.key); err != nil {
+				monitoringContext.Error("Could not delete small object when attempting to delete small "+
+					"objects for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()),
+					zap.Time("day", day), zap.String("key", object.key))
+				recordDayFailure(monitoringContext, options.lock, compactionDay, models.CompactionFailed, err)
+				return 0, err
+			}
+		}
+	}
+
+	compactionDay.Status = models.CompactionSucceeded
+	compactionDay.LastError = nil
+	compactionDay.UpdatedAt = time.Now()
+	if err := db.UpsertCompactionDay(checkpointContext(monitoringContext), options.lock, compactionDay); err != nil {
+		monitoringContext.Error("Unable to record success in compaction ledger",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+
+		return 0, err
+	}
+
+	return compactionDay.DuplicateCount, nil
+}
+
+// writeDayObject merges every small object into the day object.  Records whose Id has already been seen are dropped,
+// and invalid records are kept aside in the merge as dead letters.
+func writeDayObject(monitoringContext *monitoring.Context, dayKey string, smallObjects []smallObject, merge *recordMerge) (compactedObject, error) {
+	upload, err := startObjectUpload(monitoringContext, dayKey)
+	if err != nil {
+		return compactedObject{}, err
+	}
+
+	for _, object := range smallObjects {
+		if err := mergeObject(monitoringContext, upload, object.key, merge); err != nil {
+			upload.abort(err)
+			return compactedObject{}, err
+		}
+	}
+
+	return upload.finish()
+}
+
+// listDayObjects returns the small objects for the day, and the keys of any day objects already written.  Only the
+// keys and sizes are held in memory.
+func listDayObjects(monitoringContext *monitoring.Context, subscription models.Subscription, day time.Time) (smallObjects []smallObject, dayObjectKeys []string, err error) {
+	err = storage.ForEachObject(monitoringContext, storage.AccessLogs, getDayPrefix(subscription, day), func(object storage.ObjectInfo) {
+		if strings.Contains(object.Key, "/day") {
+			dayObjectKeys = append(dayObjectKeys, object.Key)
+			return
+		}
+
+		smallObjects = append(smallObjects, smallObject{key: object.Key, size: object.Size})
+	})
+
+	return smallObjects, dayObjectKeys, err
+}
+
+// getIdsCompactedInWindow returns the Ids of the records already compacted into the day objects for the windowDays
+// days before day, so a record retried across midnight is only counted once.
+func getIdsCompactedInWindow(monitoringContext *monitoring.Context, subscription models.Subscription, day time.Time, windowDays int) (map[uuid2.UUID]struct{}, error) {
+	seenIds := make(map[uuid2.UUID]struct{})
+
+	for i := 1; i <= windowDays; i++ {
+		previousDay := day.AddDate(0, 0, -i)
+		if previousDay.Before(utils.ToDay(subscription.CreatedAt.UTC())) {
+			break
+		}
+
+		_, dayObjectKeys, err := listDayObjects(monitoringContext, subscription, previousDay)
+		if err != nil {
+			return nil, err
+		}
+
+		err = addCompactedIds(monitoringContext, seenIds, dayObjectKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return seenIds, nil
+}
+
+// addCompactedIds adds the Id of every record in the day objects to seenIds
+func addCompactedIds(monitoringContext *monitoring.Context, seenIds map[uuid2.UUID]struct{}, dayObjectKeys []string) error {
+	for _, key := range dayObjectKeys {
+		err := forEachLine(monitoringContext, key, func(line []byte) error {
+			var record models.AccessLogRecord
+			if err := json.Unmarshal(line, &record); err == nil {
+				seenIds[record.Id] = struct{}{}
+			}
+			return nil
+		})
+
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func reportDryRun(monitoringContext *monitoring.Context, subscription models.Subscription, day time.Time, dayKey string, dayObjectExists bool, smallObjects []smallObject) {
+	keys := make([]string, len(smallObjects))
+	var bytes int64
+	for i, object := range smallObjects {
+		keys[i] = object.key
+		bytes += object.size
+	}
+
+	if len(smallObjects) == 0 {
+		monitoringContext.Info("Dry run: no small objects to compact",
+			zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
+		return
+	}
+
+	if !dayObjectExists {
+		monitoringContext.Info("Dry run: would compact small objects into day object then delete them",
+			zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day), zap.String("dayKey", dayKey),
+			zap.Int("objects", len(smallObjects)), zap.Int64("bytes", bytes), zap.Strings("keys", keys))
+		return
+	}
+
+	monitoringContext.Info("Dry run: day object already exists, would compact small objects into another day object then delete them",
+		zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day), zap.String("dayKey", dayKey),
+		zap.Int("objects", len(smallObjects)), zap.Int64("bytes", bytes), zap.Strings("keys", keys))
+}
+
+func getDayPrefix(subscription models.Subscription, day time.Time) string {
+	return fmt.Sprintf("%s/%s", subscription.Id.String(), day.Format("2006/01/02"))
+}
+
+func recordDayFailure(monitoringContext *monitoring.Context, lock models.CronLock, compactionDay models.CompactionDay, status models.CompactionStatus, cause error) {
+	compactionDay.Status = status
+	compactionDay.LastError = utils.StringPtr(cause.Error())
+	compactionDay.UpdatedAt = time.Now()
+	err := db.UpsertCompactionDay(checkpointContext(monitoringContext), lock, compactionDay)
+	if err != nil {
+		monitoringContext.Error("Unable to record failure in compaction ledger",
+			zap.Error(err), zap.String("subscriptionId", compactionDay.SubscriptionId.String()), zap.Time("day", compactionDay.Day))
+	}
+}
@@ -1,20 +1,14 @@
 package cron
 
 import (
-	"bytes"
-	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-co-op/gocron"
-	"github.com/labstack/echo/v4"
+	uuid2 "github.com/google/uuid"
 	"go.uber.org/zap"
-	"io"
-	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
-	"strings"
-	"subscriptions/src/aws"
 	"subscriptions/src/config"
 	db "subscriptions/src/database"
 	"subscriptions/src/models"
@@ -23,340 +17,253 @@ import (
 	"time"
 )
 
+var scheduler *gocron.Scheduler
+
+// ErrShuttingDown is returned when a run is asked for after StopCronJobs has been called
+var ErrShuttingDown = errors.New("cron jobs are shutting down")
+
+// StartCronJobs schedules every registered job which has a schedule in the profile, jobs without one only run when
+// triggered through the API
 func StartCronJobs() {
 	monitoring.GlobalContext.Info("Scheduling cron jobs")
-	scheduler := gocron.NewScheduler(time.UTC)
-	//_, err := scheduler.Every(1).Day().At("00:20").Do(AttemptToLockThenDo("access-log-compaction", CompactionCron))
-	//if err != nil {
-	//	monitoring.GlobalContext.Fatal("Unable to schedule access log compaction", zap.Error(err))
-	//}
+	scheduler = gocron.NewScheduler(time.UTC)
 
-	scheduler.StartAsync()
-}
-func ForceCronJob(c echo.Context) error {
-	switch c.QueryParam("cronName") {
-	case "access-log-compaction":
-		CompactionCron()
-		c.NoContent(http.StatusOK)
-	default:
-		c.NoContent(http.StatusNotFound)
+	for _, job := range GetJobs() {
+		schedule := config.GetConfig().CronConfig.Schedules[job.Name]
+		if schedule == "" {
+			monitoring.GlobalContext.Info("No schedule configured for cron job", zap.String("cronName", job.Name))
+			continue
+		}
+
+		_, err := scheduler.Cron(schedule).Do(AttemptToLockThenDo(job, url.Values{}))
+		if err != nil {
+			monitoring.GlobalContext.Fatal("Unable to schedule cron job",
+				zap.Error(err), zap.String("cronName", job.Name), zap.String("schedule", schedule))
+		}
+
+		monitoring.GlobalContext.Info("Scheduled cron job", zap.String("cronName", job.Name), zap.String("schedule", schedule))
 	}
 
-	return nil
+	scheduler.StartAsync()
 }
 
-func AttemptToLockThenDo(cronName string, action func()) func() {
-	return func() {
-		gotLock := db.AttemptToGetLock(cronName)
+// StopCronJobs stops scheduling jobs and cancels the runs in progress on this pod, then waits until they have recorded
+// where they got to and released their locks, or ctx is done.  Any locks still held once ctx is done are released
+// regardless so another pod can take over without waiting for the lease to run out.
+func StopCronJobs(ctx context.Context) {
+	if scheduler != nil {
+		scheduler.Stop()
+	}
 
-		if gotLock {
-			monitoring.GlobalContext.Info("Got lock for cron " + cronName + ".  Performing task")
-			action()
-			return
-		}
+	monitoring.GlobalContext.Info("Cancelling cron jobs in progress")
+	finished := runs.stop()
 
-		monitoring.GlobalContext.Info("Could not get lock for cron " + cronName)
+	select {
+	case <-finished:
+		monitoring.GlobalContext.Info("Cron jobs finished")
+	case <-ctx.Done():
+		monitoring.GlobalContext.Error("Cron jobs did not finish before shutdown deadline, releasing their locks")
+		for _, lock := range runs.heldLocks() {
+			releaseLock(lock)
+		}
 	}
 }
 
-const subscriptionsPageSize = 50
+// defaultLockTtl is used when neither the job nor the profile sets how long a lock is held for between heartbeats
+const defaultLockTtl = 5 * time.Minute
 
-func CompactionCron() {
-	subscriptionIdsOffset := 0
-	page, err := db.GetSubscriptionsPage(monitoring.GlobalContext, subscriptionsPageSize, subscriptionIdsOffset)
-	if err != nil {
-		monitoring.GlobalContext.Error("Could not get page of Subscription Ids when attempting to compact into day "+
-			"objects", zap.Error(err))
-		return
+// getDefaultLockLease is the lease for jobs which do not set their own
+func getDefaultLockLease() time.Duration {
+	ttl := time.Duration(config.GetConfig().CronConfig.LockTtlSeconds) * time.Second
+	if ttl <= 0 {
+		return defaultLockTtl
 	}
 
-	for _, subscription := range page {
-		go processSubscription(subscription)
-	}
+	return ttl
 }
 
-func processSubscription(subscription models.Subscription) {
-	monitoring.GlobalContext.Info("Starting s3 compact", zap.String("subscriptionId", subscription.Id.String()))
-	checkpointExists, checkpoint, err := db.GetCompactionCheckpoint(monitoring.GlobalContext, subscription.Id)
-	if err != nil {
-		monitoring.GlobalContext.Error("Could not get compaction checkpoint ",
-			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()))
-		return
-	}
-
-	var currentDay time.Time
-	var end = utils.ToDay(time.Now())
-	if !checkpointExists || checkpoint.SucceededAt == nil {
-		currentDay = utils.ToDay(subscription.CreatedAt)
-		checkpoint = models.CompactionCheckpoint{
-			SubscriptionId: subscription.Id,
-			SucceededAt:    nil,
-			FailedAt:       nil,
+// AttemptToLockThenDo is what the scheduler runs.  Runs which fall due before the database has been migrated are
+// skipped, as the server starts before then.
+func AttemptToLockThenDo(job Job, parameters url.Values) func() {
+	return func() {
+		if !db.IsInitialized() {
+			monitoring.GlobalContext.Info("Skipping cron " + job.Name + " as the database is not ready")
+			return
 		}
-	} else {
-		currentDay = utils.ToDay(*checkpoint.SucceededAt)
-	}
 
-	for currentDay.Before(end) {
-		monitoring.GlobalContext.Info("Starting s3 compact day", zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", currentDay))
-		if err = processSubscriptionDay(subscription, checkpoint, currentDay); err != nil {
+		lock, run, started, err := startRun(job, models.CronJobRunScheduled)
+		if err != nil || !started {
 			return
 		}
-		monitoring.GlobalContext.Info("Finished s3 compact day", zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", currentDay))
 
-		currentDay = currentDay.Add(time.Hour * 24)
+		monitoring.GlobalContext.Info("Got lock for cron " + job.Name + ".  Performing task")
+		executeRun(job, lock, run, parameters)
 	}
 }
 
-func processSubscriptionDay(subscription models.Subscription, checkpoint models.CompactionCheckpoint, day time.Time) error {
-	var continuationToken *string
-	onlyDelete := false
-	anythingWritten := false
+// TriggerJob starts a run of the job in the background, unless another pod holds its lock
+func TriggerJob(job Job, parameters url.Values) (run models.CronJobRun, started bool, err error) {
+	lock, run, started, err := startRun(job, models.CronJobRunManual)
+	if err != nil || !started {
+		return run, started, err
+	}
 
-	dayFileName := getTmpFileName(subscription, day)
+	go executeRun(job, lock, run, parameters)
 
-	if utils.FileExists(dayFileName) {
-		err := os.Remove(dayFileName)
-		if err != nil {
-			monitoring.GlobalContext.Error("Could not remove day file", zap.Error(err))
-			return err
-		}
-	}
+	return run, true, nil
+}
 
-	dayFile, err := os.Create(dayFileName)
+// startRun acquires the job's lock and records that a run has started, returning false if the lock is held elsewhere
+func startRun(job Job, trigger models.CronJobRunTrigger) (models.CronLock, models.CronJobRun, bool, error) {
+	hostname, err := os.Hostname()
 	if err != nil {
-		monitoring.GlobalContext.Error("Could not create day file", zap.Error(err))
-		return err
+		hostname = "Unknown"
 	}
 
-continuationLoop:
-	for {
-		response, err := aws.S3Client.ListObjectsV2(monitoring.GlobalContext, &s3.ListObjectsV2Input{
-			Bucket:            &config.GetConfig().BucketConfig.AccessLogBucket,
-			ContinuationToken: continuationToken,
-			MaxKeys:           50,
-			Prefix:            utils.StringPtr(fmt.Sprintf("%s/%s", subscription.Id.String(), day.Format("2006/01/02"))),
-		})
-		if err != nil {
-			monitoring.GlobalContext.Error("Could not list objects when attempting to compact into day "+
-				"object for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-			attemptToMarkLastFailure(checkpoint)
-			return err
-		}
-
-		for _, objectInfo := range response.Contents {
-			if strings.Contains(*objectInfo.Key, "/day") {
-				onlyDelete = true
-				break continuationLoop
-			}
-
-			object, err := aws.S3Client.GetObject(monitoring.GlobalContext, &s3.GetObjectInput{
-				Bucket: utils.StringPtr(config.GetConfig().BucketConfig.AccessLogBucket),
-				Key:    objectInfo.Key,
-			})
-			if err != nil {
-				monitoring.GlobalContext.Error("Could not get object when attempting to compact into day "+
-					"object for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-				attemptToMarkLastFailure(checkpoint)
-				return err
-			}
-
-			all, err := io.ReadAll(object.Body)
-			if err != nil {
-				monitoring.GlobalContext.Error("Could not read object when attempting to compact into day "+
-					"object for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-				attemptToMarkLastFailure(checkpoint)
-				return err
-			}
-
-			gz, err := gzip.NewReader(bytes.NewBuffer(all))
-			if err != nil {
-				monitoring.GlobalContext.Error("Could not create gzip reader for Subscription",
-					zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-				attemptToMarkLastFailure(checkpoint)
-				return err
-			}
-
-			ungzipped, err := ioutil.ReadAll(gz)
-			gz.Close()
-			if err != nil {
-				monitoring.GlobalContext.Error("Could not un-gzip object for Subscription",
-					zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-				attemptToMarkLastFailure(checkpoint)
-				return err
-			}
-
-			_, err = dayFile.Write(append(ungzipped, "\n"...))
-			if err != nil {
-				monitoring.GlobalContext.Error("Could not write to day file when attempting to compact into day "+
-					"object for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-				return err
-			}
-
-			anythingWritten = true
-		}
-
-		continuationToken = response.ContinuationToken
-
-		if continuationToken == nil {
-			break
-		}
+	run := models.CronJobRun{
+		Id:        uuid2.New(),
+		Name:      job.Name,
+		Host:      hostname,
+		Trigger:   trigger,
+		Status:    models.CronJobRunRunning,
+		StartedAt: time.Now().UTC(),
+		Summary:   models.CronJobRunSummary{},
 	}
 
-	err = dayFile.Close()
+	lock, acquired, err := db.AcquireCronLock(monitoring.GlobalContext, job.Name, hostname, job.GetLockLease())
 	if err != nil {
-		monitoring.GlobalContext.Error("Could not close day file when attempting to compact into day "+
-			"object for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-		return err
+		monitoring.GlobalContext.Error("Could not get lock for cron job", zap.Error(err), zap.String("cronName", job.Name))
+		return lock, run, false, err
 	}
 
-	if !onlyDelete && anythingWritten {
-		if err := writeDayFileFromTmp(subscription, day); err != nil {
-			monitoring.GlobalContext.Error("Unable to write day file",
-				zap.Error(err), zap.String("subscriptionId", checkpoint.SubscriptionId.String()), zap.Time("succeededAt", *checkpoint.SucceededAt))
+	if !acquired {
+		monitoring.GlobalContext.Info("Could not get lock for cron " + job.Name)
+		return lock, run, false, nil
+	}
 
-			return err
-		}
+	if !runs.add(run.Id, lock) {
+		monitoring.GlobalContext.Info("Not starting cron job as shutting down", zap.String("cronName", job.Name))
+		releaseLock(lock)
+		return lock, run, false, ErrShuttingDown
 	}
 
-	if anythingWritten {
-		var deleteContinuationToken *string
-		for {
-			response, err := aws.S3Client.ListObjectsV2(monitoring.GlobalContext, &s3.ListObjectsV2Input{
-				Bucket:            &config.GetConfig().BucketConfig.AccessLogBucket,
-				ContinuationToken: deleteContinuationToken,
-				MaxKeys:           50,
-				Prefix:            utils.StringPtr(fmt.Sprintf("%s/%s", subscription.Id.String(), day.Format("2006/01/02"))),
-			})
-			if err != nil {
-				monitoring.GlobalContext.Error("Could not list objects when attempting to delete small "+
-					"objects for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("day", day))
-				attemptToMarkLastFailure(checkpoint)
-				return err
-			}
+	if err := db.StartCronJobRun(monitoring.GlobalContext, lock, run); err != nil {
+		monitoring.GlobalContext.Error("Could not record start of cron job run", zap.Error(err), zap.String("cronName", job.Name))
+		releaseLock(lock)
+		runs.done(run.Id)
+		return lock, run, false, err
+	}
 
-			for _, objectInfo := range response.Contents {
-				if strings.Contains(*objectInfo.Key, "/day") {
-					continue
-				}
+	return lock, run, true, nil
+}
 
-				_, err := aws.S3Client.DeleteObject(monitoring.GlobalContext, &s3.DeleteObjectInput{
-					Bucket: &config.GetConfig().BucketConfig.AccessLogBucket,
-					Key:    objectInfo.Key,
-				})
-				if err != nil {
-					monitoring.GlobalContext.Error("Could not delete small object when attempting to delete small "+
-						"objects for Subscription", zap.Error(err), zap.String("subscriptionId", subscription.Id.String()),
-						zap.Time("day", day), zap.String("key", *objectInfo.Key))
-					return err
-				}
-			}
+// executeRun runs the job while renewing its lock, records how it finished and then releases the lock
+func executeRun(job Job, lock models.CronLock, run models.CronJobRun, parameters url.Values) {
+	defer runs.done(run.Id)
+	defer releaseLock(lock)
 
-			deleteContinuationToken = response.ContinuationToken
+	ctx, cancel := context.WithTimeout(runs.ctx, job.Timeout)
+	defer cancel()
 
-			if deleteContinuationToken == nil {
-				break
-			}
-		}
-	}
+	stopHeartbeat := make(chan struct{})
+	lostLock := keepLockAlive(lock, job.GetLockLease(), cancel, stopHeartbeat)
 
-	if err := markLastSuccess(checkpoint); err != nil {
-		monitoring.GlobalContext.Error("Unable to mark last success on compaction checkpoint",
-			zap.Error(err), zap.String("subscriptionId", checkpoint.SubscriptionId.String()), zap.Time("succeededAt", *checkpoint.SucceededAt))
+	summary, err := runJob(ctx, job, lock, parameters)
 
-		return err
+	close(stopHeartbeat)
+	if lockErr := <-lostLock; lockErr != nil {
+		err = lockErr
 	}
 
-	return nil
-}
-
-func writeDayFileFromTmp(subscription models.Subscription, day time.Time) error {
-	file, err := os.Open(getTmpFileName(subscription, day))
-	if err != nil {
-		monitoring.GlobalContext.Error("Could not open tmp day file to write to S3", zap.Error(err))
-		return err
+	endedAt := time.Now().UTC()
+	run.EndedAt = &endedAt
+	run.Status = models.CronJobRunSucceeded
+	if summary != nil {
+		run.Summary = summary
 	}
 
-	handle, err := os.Create(getTmpFileName(subscription, day) + ".gz")
+	if err == context.DeadlineExceeded {
+		run.Status = models.CronJobRunTimedOut
+	} else if err == context.Canceled {
+		run.Status = models.CronJobRunCancelled
+	} else if err != nil {
+		run.Status = models.CronJobRunFailed
+	}
 	if err != nil {
-		monitoring.GlobalContext.Error("Could not open tmp day gz file to write to S3", zap.Error(err))
-		return err
+		run.Error = utils.StringPtr(err.Error())
 	}
 
-	zipWriter, err := gzip.NewWriterLevel(handle, 9)
-	if err != nil {
-		monitoring.GlobalContext.Error("Could not create tmp day gz writer to write to S3", zap.Error(err))
-		return err
+	if err := db.FinishCronJobRun(monitoring.GlobalContext, run); err != nil {
+		monitoring.GlobalContext.Error("Could not record end of cron job run",
+			zap.Error(err), zap.String("cronName", job.Name), zap.String("runId", run.Id.String()))
 	}
+}
 
-	for {
-		buf := make([]byte, 0, 4*1024)
-		n, err := file.Read(buf[:cap(buf)])
-		buf = buf[:n]
-		if n == 0 {
-			if err == nil {
-				continue
-			}
-			if err == io.EOF {
-				break
-			}
+// keepLockAlive renews the lock for another lease every third of the lease until stop is closed.  If the lease is lost the job is cancelled,
+// as its checkpoints would be refused anyway, and the error is sent on the returned channel before it is closed.
+func keepLockAlive(lock models.CronLock, lease time.Duration, cancel context.CancelFunc, stop chan struct{}) chan error {
+	lostLock := make(chan error, 1)
 
-		}
+	go func() {
+		defer close(lostLock)
 
-		if err != nil && err != io.EOF {
-			monitoring.GlobalContext.Error("Could not read day file into gz writer to write to S3", zap.Error(err))
-			return err
-		}
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
 
-		_, err = zipWriter.Write(buf)
-		if err != nil && err != io.EOF {
-			monitoring.GlobalContext.Error("Could not write to zip writer", zap.Error(err))
-			return err
-		}
-	}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := db.RenewCronLock(monitoring.GlobalContext, lock, lease)
+				if err == db.ErrCronLockLost {
+					monitoring.GlobalContext.Error("Lost lock for cron job, cancelling it",
+						zap.String("cronName", lock.Name), zap.Int64("fencingToken", lock.FencingToken))
+					lostLock <- err
+					cancel()
+					return
+				}
 
-	zipWriter.Close()
-	handle.Close()
+				// Anything else is retried on the next tick, while there is still time left on the lease
+				if err != nil {
+					monitoring.GlobalContext.Warn("Could not renew lock for cron job",
+						zap.Error(err), zap.String("cronName", lock.Name))
+				}
+			}
+		}
+	}()
 
-	dayFileUploader := manager.NewUploader(aws.S3Client, func(u *manager.Uploader) {
-		u.PartSize = 0
-		u.Concurrency = 1
-		u.LeavePartsOnError = false
-	})
+	return lostLock
+}
 
-	gzippedFile, err := os.Open(getTmpFileName(subscription, day) + ".gz")
+func releaseLock(lock models.CronLock) {
+	if err := db.ReleaseCronLock(monitoring.GlobalContext, lock); err != nil {
+		monitoring.GlobalContext.Error("Could not release lock for cron job", zap.Error(err), zap.String("cronName", lock.Name))
+	}
+}
 
-	_, err = dayFileUploader.Upload(monitoring.GlobalContext, &s3.PutObjectInput{
-		Bucket: utils.StringPtr(config.GetConfig().BucketConfig.AccessLogBucket),
-		Key:    utils.StringPtr(fmt.Sprintf("%s/%s/day.gz", subscription.Id.String(), day.Format("2006/01/02"))),
-		Body:   gzippedFile,
-	})
+// runJob runs the job until it finishes or ctx is done.  A job that panics is failed rather than taking the server
+// down with it.
+func runJob(ctx context.Context, job Job, lock models.CronLock, parameters url.Values) (summary models.CronJobRunSummary, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			monitoring.GlobalContext.Error("Cron job panicked", zap.String("cronName", job.Name), zap.Any("panic", recovered))
+			err = fmt.Errorf("cron job panicked: %v", recovered)
+		}
+	}()
 
-	gzippedFile.Close()
+	monitoringContext := monitoring.NewMonitoringContext(monitoring.GlobalContext.Logger.With(zap.String("cronName", job.Name)), ctx)
+	summary, err = job.Run(monitoringContext, lock, parameters)
 
-	removeErr := os.Remove(getTmpFileName(subscription, day))
-	if removeErr != nil {
-		monitoring.GlobalContext.Error("Could not delete tmp day file", zap.String("subscriptionId",
-			subscription.Id.String()), zap.Error(removeErr))
+	if ctx.Err() == context.DeadlineExceeded {
+		monitoring.GlobalContext.Error("Cron job timed out", zap.String("cronName", job.Name), zap.Duration("timeout", job.Timeout))
+		return summary, context.DeadlineExceeded
 	}
 
-	return err
-}
-
-func getTmpFileName(subscription models.Subscription, day time.Time) string {
-	return fmt.Sprintf("/tmp/dayfiles/%s-%s-day", subscription.Id.String(), day.Format("2006-01-02"))
-}
-
-func attemptToMarkLastFailure(checkpoint models.CompactionCheckpoint) {
-	checkpoint.FailedAt = utils.TimePtr(time.Now())
-	err := db.UpsertCompactionCheckpoint(monitoring.GlobalContext, checkpoint)
-	if err != nil {
-		monitoring.GlobalContext.Error("Unable to mark last failure on compaction checkpoint",
-			zap.Error(err), zap.String("subscriptionId", checkpoint.SubscriptionId.String()), zap.Time("failedAt", *checkpoint.FailedAt))
+	if ctx.Err() == context.Canceled {
+		monitoring.GlobalContext.Info("Cron job cancelled", zap.String("cronName", job.Name))
+		return summary, context.Canceled
 	}
-}
 
-func markLastSuccess(checkpoint models.CompactionCheckpoint) error {
-	checkpoint.SucceededAt = utils.TimePtr(time.Now())
-	return db.UpsertCompactionCheckpoint(monitoring.GlobalContext, checkpoint)
+	return summary, err
 }
@@ -0,0 +1,74 @@
+package cron
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	uuid2 "github.com/google/uuid"
+	"path"
+	"subscriptions/src/config"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+)
+
+// deadLetter is a line from a small object which could not be compacted, written to the dead-letter prefix so it can
+// be inspected and replayed by hand
+type deadLetter struct {
+	SourceKey string
+	Reason    string
+	Line      string
+}
+
+// unreadableObject is a small object which could not be un-gzipped, it is copied to the dead-letter prefix as is
+type unreadableObject struct {
+	key    string
+	reason string
+}
+
+// writeDeadLetters puts the invalid lines from the merge into a single gzipped object of JSON lines, and copies each
+// unreadable object across with the reason in its metadata.  They are kept under the dead-letter prefix followed by
+// the prefix the sources were compacted from.
+func writeDeadLetters(monitoringContext *monitoring.Context, sourcePrefix string, merge *recordMerge) error {
+	prefix := fmt.Sprintf("%s/%s", config.GetConfig().BucketConfig.DeadLetterPrefix, sourcePrefix)
+
+	if len(merge.deadLetters) > 0 {
+		var buf bytes.Buffer
+		zipWriter := gzip.NewWriter(&buf)
+		encoder := json.NewEncoder(zipWriter)
+		for _, letter := range merge.deadLetters {
+			if err := encoder.Encode(letter); err != nil {
+				return err
+			}
+		}
+		if err := zipWriter.Close(); err != nil {
+			return err
+		}
+
+		err := storage.AccessLogs.Put(monitoringContext, fmt.Sprintf("%s/lines-%s.gz", prefix, uuid2.NewString()), &buf, nil)
+		if err != nil {
+			return fmt.Errorf("could not write dead-letter lines: %w", err)
+		}
+	}
+
+	for _, object := range merge.unreadableObjects {
+		if err := copyUnreadableObject(monitoringContext, object, prefix); err != nil {
+			return fmt.Errorf("could not copy unreadable object %s to dead-letter prefix: %w", object.key, err)
+		}
+	}
+
+	return nil
+}
+
+// copyUnreadableObject copies the object through this process rather than server side, so it works with any store.
+// Unreadable objects are small objects written by the gateway so are never large.
+func copyUnreadableObject(monitoringContext *monitoring.Context, object unreadableObject, prefix string) error {
+	body, err := storage.AccessLogs.Get(monitoringContext, object.key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return storage.AccessLogs.Put(monitoringContext, fmt.Sprintf("%s/objects/%s", prefix, path.Base(object.key)), body,
+		map[string]string{"dead-letter-reason": object.reason})
+}
@@ -0,0 +1,67 @@
+package cron
+
+import (
+	"context"
+	"net/url"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"time"
+)
+
+// Job is a background task which StartCronJobs runs on the schedule configured for its name, and which can be forced
+// to run by name.  Jobs register themselves from an init function in the file that implements them.
+type Job struct {
+	Name string
+	// Timeout is when the job is told to stop through its context
+	Timeout time.Duration
+	// LockLease is how long the job's lock is held for between heartbeats, so how long another pod waits to take over
+	// from a pod which died while running it.  Jobs without one use the profile's LockTtlSeconds.
+	LockLease time.Duration
+	// Run does the work while holding the job's lock, returning counts to record against the run and an error if the
+	// run should be marked failed.  Checkpoints must be written fenced by the lock.
+	Run func(monitoringContext *monitoring.Context, lock models.CronLock, parameters url.Values) (models.CronJobRunSummary, error)
+}
+
+var registeredJobs []Job
+
+func registerJob(job Job) {
+	if _, exists := GetJob(job.Name); exists {
+		panic("Cron job registered twice: " + job.Name)
+	}
+
+	registeredJobs = append(registeredJobs, job)
+}
+
+// GetLockLease returns how long the job's lock is held for before it has to be renewed
+func (job Job) GetLockLease() time.Duration {
+	if job.LockLease > 0 {
+		return job.LockLease
+	}
+
+	return getDefaultLockLease()
+}
+
+// GetJobs returns every registered job in the order they were registered
+func GetJobs() []Job {
+	return registeredJobs
+}
+
+func GetJob(name string) (Job, bool) {
+	for _, job := range registeredJobs {
+		if job.Name == name {
+			return job, true
+		}
+	}
+
+	return Job{}, false
+}
+
+// checkpointContext is for the writes that record how far a job got, and for cleaning up after it.  It keeps the job's
+// logger but is never cancelled, so a job stopped by shutdown or its timeout still leaves the ledger consistent.
+func checkpointContext(monitoringContext *monitoring.Context) *monitoring.Context {
+	return &monitoring.Context{
+		Context:  context.Background(),
+		Logger:   monitoringContext.Logger,
+		NewRelic: monitoringContext.NewRelic,
+	}
+}
@@ -0,0 +1,94 @@
+package cron
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xitongsys/parquet-go/writer"
+	"strings"
+	"subscriptions/src/config"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+)
+
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+// parquetAccessLogRecord has the same columns as the usage report table created by setupTable
+type parquetAccessLogRecord struct {
+	Id             string `parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	OccurredAt     int64  `parquet:"name=occurred_at, type=INT64"`
+	Product        string `parquet:"name=product, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Method         string `parquet:"name=method, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Path           string `parquet:"name=path, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AndroidId      string `parquet:"name=android_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SubscriptionId string `parquet:"name=subscription_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// getParquetKey returns where the Parquet copy of a compacted object goes, which mirrors its key under the Parquet
+// prefix so the usage report tables never see the gzipped JSON
+func getParquetKey(compactedKey string) string {
+	return fmt.Sprintf("%s/%s.parquet", config.GetConfig().BucketConfig.ParquetPrefix, strings.TrimSuffix(compactedKey, ".gz"))
+}
+
+// writeParquetCopy reads the records back out of a compacted object and writes them to a Parquet object.  The
+// compacted object has already been validated, so any line which does not parse is an error.
+func writeParquetCopy(monitoringContext *monitoring.Context, object compactedObject) (parquetKey string, err error) {
+	parquetKey = getParquetKey(object.key)
+	pipeWriter, result := streamUpload(monitoringContext, parquetKey)
+
+	parquetWriter, err := writer.NewParquetWriterFromWriter(pipeWriter, new(parquetAccessLogRecord), 1)
+	if err != nil {
+		pipeWriter.CloseWithError(err)
+		<-result
+		return "", err
+	}
+	parquetWriter.RowGroupSize = parquetRowGroupSize
+
+	var rows int64
+	err = forEachLine(monitoringContext, object.key, func(line []byte) error {
+		var record models.AccessLogRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("could not parse record in compacted object %s: %w", object.key, err)
+		}
+
+		rows++
+		return parquetWriter.Write(parquetAccessLogRecord{
+			Id:             record.Id.String(),
+			OccurredAt:     record.OccurredAt,
+			Product:        record.Product,
+			Method:         record.Method,
+			Path:           record.Path,
+			AndroidId:      record.AndroidId,
+			SubscriptionId: record.SubscriptionId.String(),
+		})
+	})
+	if err == nil {
+		err = parquetWriter.WriteStop()
+	}
+	if err == nil && rows != object.counts.lines {
+		err = fmt.Errorf("wrote %d rows to %s but compacted object %s has %d records",
+			rows, parquetKey, object.key, object.counts.lines)
+	}
+	if err != nil {
+		pipeWriter.CloseWithError(err)
+		<-result
+		return "", err
+	}
+
+	pipeWriter.Close()
+	if err := <-result; err != nil {
+		return "", err
+	}
+
+	return parquetKey, nil
+}
+
+// listParquetObjects returns the keys of every Parquet object under the prefix of the compacted objects
+func listParquetObjects(monitoringContext *monitoring.Context, compactedPrefix string) (keys []string, err error) {
+	prefix := fmt.Sprintf("%s/%s/", config.GetConfig().BucketConfig.ParquetPrefix, compactedPrefix)
+	err = storage.ForEachObject(monitoringContext, storage.AccessLogs, prefix, func(object storage.ObjectInfo) {
+		keys = append(keys, object.Key)
+	})
+
+	return keys, err
+}
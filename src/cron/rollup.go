@@ -0,0 +1,387 @@
+package cron
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"net/url"
+	"subscriptions/src/config"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+	"subscriptions/src/utils"
+	"time"
+)
+
+func init() {
+	registerJob(Job{
+		Name:      "access-log-monthly-rollup",
+		Timeout:   20 * time.Hour,
+		LockLease: 10 * time.Minute,
+		Run: func(monitoringContext *monitoring.Context, lock models.CronLock, parameters url.Values) (models.CronJobRunSummary, error) {
+			return rollUp(monitoringContext, compactionOptionsFromParameters(lock, parameters))
+		},
+	})
+}
+
+// rollUp merges the day objects of every closed month into month parts, so Athena reads a handful of objects per
+// month rather than one per day
+func rollUp(monitoringContext *monitoring.Context, options compactionOptions) (models.CronJobRunSummary, error) {
+	summary := &compactionSummary{}
+	forEachSubscription(monitoringContext, func(subscription models.Subscription) {
+		summary.record(rollUpSubscription(monitoringContext, subscription, options))
+	})
+
+	monitoringContext.Info("Finished s3 monthly roll-up",
+		zap.Bool("dryRun", options.dryRun),
+		zap.Int("subscriptions", summary.subscriptions),
+		zap.Int("succeeded", summary.succeeded),
+		zap.Int("failed", summary.failed),
+		zap.Int("monthsRolledUp", summary.compacted),
+		zap.Int64("duplicates", summary.duplicates))
+
+	return summary.runSummary("monthsRolledUp")
+}
+
+// rollUpSubscription rolls up every month before the current one which the ledger does not already have as
+// succeeded.  A month is only rolled up once every day in it has been compacted.
+func rollUpSubscription(monitoringContext *monitoring.Context, subscription models.Subscription, options compactionOptions) (compaction subscriptionCompaction, err error) {
+	createdAt := subscription.CreatedAt.UTC()
+	today := utils.ToDay(time.Now().UTC())
+	currentMonth := utils.ToMonth(today)
+
+	months, err := db.GetCompactionMonths(monitoringContext, subscription.Id, utils.ToMonth(createdAt), currentMonth)
+	if err != nil {
+		monitoringContext.Error("Could not get monthly roll-up ledger",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()))
+		return compaction, err
+	}
+
+	monthsByStart := make(map[string]models.CompactionMonth, len(months))
+	for _, compactionMonth := range months {
+		monthsByStart[compactionMonth.Month.Format("2006-01")] = compactionMonth
+	}
+
+	days, err := db.GetCompactionDays(monitoringContext, subscription.Id, utils.ToDay(createdAt), today)
+	if err != nil {
+		monitoringContext.Error("Could not get compaction ledger",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()))
+		return compaction, err
+	}
+
+	compactedDays := make(map[string]bool, len(days))
+	for _, compactionDay := range days {
+		compactedDays[compactionDay.Day.Format("2006-01-02")] = compactionDay.Status == models.CompactionSucceeded
+	}
+
+	var firstErr error
+	for month := utils.ToMonth(createdAt); month.Before(currentMonth); month = utils.ToNextMonth(month) {
+		if err := monitoringContext.Err(); err != nil {
+			return compaction, err
+		}
+
+		compactionMonth, exists := monthsByStart[month.Format("2006-01")]
+		if exists && compactionMonth.Status == models.CompactionSucceeded {
+			continue
+		}
+
+		if !isMonthCompacted(subscription, month, compactedDays) {
+			monitoringContext.Info("Not rolling up month as not every day has been compacted",
+				zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+			continue
+		}
+
+		if !exists {
+			compactionMonth = models.CompactionMonth{SubscriptionId: subscription.Id, Month: month}
+		}
+
+		monitoringContext.Info("Starting s3 roll-up month", zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+		duplicates, err := processSubscriptionMonth(monitoringContext, subscription, compactionMonth, options)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		monitoringContext.Info("Finished s3 roll-up month", zap.String("subscriptionId", subscription.Id.String()),
+			zap.Time("month", month), zap.Int64("duplicates", duplicates))
+
+		compaction.compacted++
+		compaction.duplicates += duplicates
+	}
+
+	return compaction, firstErr
+}
+
+func isMonthCompacted(subscription models.Subscription, month time.Time, compactedDays map[string]bool) bool {
+	day := month
+	if createdDay := utils.ToDay(subscription.CreatedAt.UTC()); createdDay.After(day) {
+		day = createdDay
+	}
+
+	for ; day.Before(utils.ToNextMonth(month)); day = day.AddDate(0, 0, 1) {
+		if !compactedDays[day.Format("2006-01-02")] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// processSubscriptionMonth merges every object in the month into size bounded parts, and returns how many duplicate
+// records were dropped while doing so.  Parts left behind by an earlier failed attempt are merged in as well, so
+// nothing is lost if that attempt got as far as deleting some of its sources.
+func processSubscriptionMonth(monitoringContext *monitoring.Context, subscription models.Subscription, compactionMonth models.CompactionMonth, options compactionOptions) (int64, error) {
+	month := compactionMonth.Month
+	monthPrefix := getMonthPrefix(subscription, month)
+	compactionMonth.Attempts++
+
+	sources, err := listMonthObjects(monitoringContext, monthPrefix)
+	if err != nil {
+		monitoringContext.Error("Could not list objects when attempting to roll up month",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+		recordMonthFailure(monitoringContext, options.lock, compactionMonth, models.CompactionFailed, err)
+		return 0, err
+	}
+
+	partPrefix := fmt.Sprintf("%s/month/attempt-%d", monthPrefix, compactionMonth.Attempts)
+	if options.dryRun {
+		reportRollUpDryRun(monitoringContext, subscription, month, partPrefix, sources)
+		return 0, nil
+	}
+
+	merge := newRecordMerge(subscription.Id, nil)
+	var parts []compactedObject
+	if len(sources) > 0 {
+		parts, err = writeMonthParts(monitoringContext, partPrefix, sources, merge, options.monthPartMaxBytes)
+		if err != nil {
+			monitoringContext.Error("Unable to write month parts",
+				zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+			recordMonthFailure(monitoringContext, options.lock, compactionMonth, models.CompactionFailed, err)
+			return 0, err
+		}
+	}
+
+	if options.verifyBeforeDelete {
+		for _, part := range parts {
+			if err := verifyCompactedObject(monitoringContext, part); err != nil {
+				monitoringContext.Error("Month part failed verification, keeping the day objects",
+					zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+				removeCompactedObjects(monitoringContext, parts)
+				recordMonthFailure(monitoringContext, options.lock, compactionMonth, models.CompactionVerificationFailed, err)
+				return 0, err
+			}
+		}
+	}
+
+	// The Parquet objects already in the month are replaced by a copy of each part once the sources are deleted
+	var staleParquetKeys, parquetKeys []string
+	if config.GetConfig().BucketConfig.IsParquetEnabled() {
+		staleParquetKeys, err = listParquetObjects(monitoringContext, monthPrefix)
+		if err == nil {
+			parquetKeys, err = writeParquetCopies(monitoringContext, parts)
+		}
+		if err != nil {
+			monitoringContext.Error("Unable to write Parquet copies of month parts, keeping the day objects",
+				zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+			removeCompactedObjects(monitoringContext, parts)
+			recordMonthFailure(monitoringContext, options.lock, compactionMonth, models.CompactionFailed, err)
+			return 0, err
+		}
+	}
+
+	if err := writeDeadLetters(monitoringContext, monthPrefix+"/month", merge); err != nil {
+		monitoringContext.Error("Unable to write dead letters, keeping the day objects",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+		removeCompactedObjects(monitoringContext, parts)
+		for _, key := range parquetKeys {
+			removeCompactedObject(monitoringContext, key)
+		}
+		recordMonthFailure(monitoringContext, options.lock, compactionMonth, models.CompactionFailed, err)
+		return 0, err
+	}
+
+	compactionMonth.SourceObjectCount = len(sources)
+	compactionMonth.SourceBytes = 0
+	for _, source := range sources {
+		compactionMonth.SourceBytes += source.size
+	}
+	compactionMonth.PartCount = len(parts)
+	compactionMonth.OutputPrefix = &partPrefix
+	compactionMonth.RecordCount = 0
+	compactionMonth.OutputBytes = 0
+	for _, part := range parts {
+		compactionMonth.RecordCount += part.counts.lines
+		compactionMonth.OutputBytes += part.counts.bytes
+	}
+	compactionMonth.DuplicateCount = merge.duplicates
+	compactionMonth.DeadLetterCount = int64(len(merge.deadLetters))
+	compactionMonth.UnreadableObjectCount = len(merge.unreadableObjects)
+
+	// Only the objects that were listed are deleted, so the parts just written are left alone
+	for _, source := range sources {
+		if err := deleteObject(monitoringContext, source.key); err != nil {
+			monitoringContext.Error("Could not delete object after rolling up month",
+				zap.Error(err), zap.String("subscriptionId", subscription.Id.String()),
+				zap.Time("month", month), zap.String("key", source.key))
+			recordMonthFailure(monitoringContext, options.lock, compactionMonth, models.CompactionFailed, err)
+			return 0, err
+		}
+	}
+
+	for _, key := range staleParquetKeys {
+		if err := deleteObject(monitoringContext, key); err != nil {
+			monitoringContext.Error("Could not delete Parquet object after rolling up month",
+				zap.Error(err), zap.String("subscriptionId", subscription.Id.String()),
+				zap.Time("month", month), zap.String("key", key))
+			recordMonthFailure(monitoringContext, options.lock, compactionMonth, models.CompactionFailed, err)
+			return 0, err
+		}
+	}
+
+	compactionMonth.Status = models.CompactionSucceeded
+	compactionMonth.LastError = nil
+	compactionMonth.UpdatedAt = time.Now()
+	if err := db.UpsertCompactionMonth(checkpointContext(monitoringContext), options.lock, compactionMonth); err != nil {
+		monitoringContext.Error("Unable to record success in monthly roll-up ledger",
+			zap.Error(err), zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month))
+
+		return 0, err
+	}
+
+	return compactionMonth.DuplicateCount, nil
+}
+
+// partedUpload starts a new part whenever the next line would take the current one over maxBytes uncompressed.  A
+// maxBytes of zero or less means everything goes into a single part.
+type partedUpload struct {
+	monitoringContext *monitoring.Context
+	keyPrefix         string
+	maxBytes          int64
+	current           *objectUpload
+	parts             []compactedObject
+}
+
+func (p *partedUpload) Write(line []byte) (int, error) {
+	if p.current != nil && p.maxBytes > 0 && p.current.uncompressed.bytes > 0 &&
+		p.current.uncompressed.bytes+int64(len(line)) > p.maxBytes {
+		if err := p.finishPart(); err != nil {
+			return 0, err
+		}
+	}
+
+	if p.current == nil {
+		upload, err := startObjectUpload(p.monitoringContext, fmt.Sprintf("%s-part-%04d.gz", p.keyPrefix, len(p.parts)))
+		if err != nil {
+			return 0, err
+		}
+		p.current = upload
+	}
+
+	return p.current.Write(line)
+}
+
+func (p *partedUpload) finishPart() error {
+	part, err := p.current.finish()
+	p.current = nil
+	if err != nil {
+		return err
+	}
+
+	p.parts = append(p.parts, part)
+	return nil
+}
+
+func (p *partedUpload) finish() ([]compactedObject, error) {
+	if p.current != nil {
+		if err := p.finishPart(); err != nil {
+			removeCompactedObjects(p.monitoringContext, p.parts)
+			return nil, err
+		}
+	}
+
+	return p.parts, nil
+}
+
+func (p *partedUpload) abort(cause error) {
+	if p.current != nil {
+		p.current.abort(cause)
+		p.current = nil
+	}
+
+	removeCompactedObjects(p.monitoringContext, p.parts)
+}
+
+func writeMonthParts(monitoringContext *monitoring.Context, partPrefix string, sources []smallObject, merge *recordMerge, maxBytes int64) ([]compactedObject, error) {
+	upload := &partedUpload{monitoringContext: monitoringContext, keyPrefix: partPrefix, maxBytes: maxBytes}
+
+	for _, source := range sources {
+		if err := mergeObject(monitoringContext, upload, source.key, merge); err != nil {
+			upload.abort(err)
+			return nil, err
+		}
+	}
+
+	return upload.finish()
+}
+
+// writeParquetCopies writes a Parquet copy of each part, removing any already written if one of them fails
+func writeParquetCopies(monitoringContext *monitoring.Context, parts []compactedObject) ([]string, error) {
+	var keys []string
+	for _, part := range parts {
+		key, err := writeParquetCopy(monitoringContext, part)
+		if err != nil {
+			for _, written := range keys {
+				removeCompactedObject(monitoringContext, written)
+			}
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func removeCompactedObjects(monitoringContext *monitoring.Context, objects []compactedObject) {
+	for _, object := range objects {
+		removeCompactedObject(monitoringContext, object.key)
+	}
+}
+
+// listMonthObjects returns every object under the month prefix, which covers day objects, small objects that arrived
+// after their day was compacted, and parts from earlier attempts
+func listMonthObjects(monitoringContext *monitoring.Context, monthPrefix string) (objects []smallObject, err error) {
+	err = storage.ForEachObject(monitoringContext, storage.AccessLogs, monthPrefix+"/", func(object storage.ObjectInfo) {
+		objects = append(objects, smallObject{key: object.Key, size: object.Size})
+	})
+
+	return objects, err
+}
+
+func reportRollUpDryRun(monitoringContext *monitoring.Context, subscription models.Subscription, month time.Time, partPrefix string, sources []smallObject) {
+	keys := make([]string, len(sources))
+	var bytes int64
+	for i, source := range sources {
+		keys[i] = source.key
+		bytes += source.size
+	}
+
+	monitoringContext.Info("Dry run: would roll up objects into month parts then delete them",
+		zap.String("subscriptionId", subscription.Id.String()), zap.Time("month", month), zap.String("partPrefix", partPrefix),
+		zap.Int("objects", len(sources)), zap.Int64("bytes", bytes), zap.Strings("keys", keys))
+}
+
+func getMonthPrefix(subscription models.Subscription, month time.Time) string {
+	return fmt.Sprintf("%s/%s", subscription.Id.String(), month.Format("2006/01"))
+}
+
+func recordMonthFailure(monitoringContext *monitoring.Context, lock models.CronLock, compactionMonth models.CompactionMonth, status models.CompactionStatus, cause error) {
+	compactionMonth.Status = status
+	compactionMonth.LastError = utils.StringPtr(cause.Error())
+	compactionMonth.UpdatedAt = time.Now()
+	err := db.UpsertCompactionMonth(checkpointContext(monitoringContext), lock, compactionMonth)
+	if err != nil {
+		monitoringContext.Error("Unable to record failure in monthly roll-up ledger",
+			zap.Error(err), zap.String("subscriptionId", compactionMonth.SubscriptionId.String()), zap.Time("month", compactionMonth.Month))
+	}
+}
@@ -0,0 +1,82 @@
+package cron
+
+import (
+	"context"
+	uuid2 "github.com/google/uuid"
+	"subscriptions/src/models"
+	"sync"
+)
+
+// activeRuns tracks the runs in progress on this pod, so that shutdown can cancel them and wait for them to finish
+type activeRuns struct {
+	mutex    sync.Mutex
+	stopping bool
+	locks    map[uuid2.UUID]models.CronLock
+	running  sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+var runs = newActiveRuns()
+
+func newActiveRuns() *activeRuns {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &activeRuns{
+		locks:  make(map[uuid2.UUID]models.CronLock),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// add records that the run is starting, returning false if the pod is shutting down and it must not start
+func (r *activeRuns) add(runId uuid2.UUID, lock models.CronLock) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopping {
+		return false
+	}
+
+	r.locks[runId] = lock
+	r.running.Add(1)
+	return true
+}
+
+func (r *activeRuns) done(runId uuid2.UUID) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.locks, runId)
+	r.running.Done()
+}
+
+// stop cancels every run and stops any more from starting.  The returned channel is closed once they have all finished.
+func (r *activeRuns) stop() chan struct{} {
+	r.mutex.Lock()
+	r.stopping = true
+	r.mutex.Unlock()
+
+	r.cancel()
+
+	finished := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(finished)
+	}()
+
+	return finished
+}
+
+// heldLocks returns the locks of the runs which have not finished yet
+func (r *activeRuns) heldLocks() []models.CronLock {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	locks := make([]models.CronLock, 0, len(r.locks))
+	for _, lock := range r.locks {
+		locks = append(locks, lock)
+	}
+
+	return locks
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	uuid2 "github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"time"
+)
+
+// GetCompactionDays returns the ledger entries for the Subscription between from and to inclusive, oldest first
+func GetCompactionDays(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) ([]models.CompactionDay, error) {
+	var result []models.CompactionDay
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM compaction_day WHERE subscription_id = $1 AND day >= $2 AND day <= $3 ORDER BY day`,
+		subscriptionId, from.Format("2006-01-02"), to.Format("2006-01-02"))
+
+	return result, err
+}
+
+// UpsertCompactionDay writes the ledger entry for the day, as long as the lock of the job compacting it is still held
+func UpsertCompactionDay(monitoringContext *monitoring.Context, lock models.CronLock, compactionDay models.CompactionDay) error {
+	return withCronLock(monitoringContext, lock, func(transaction *sqlx.Tx) error {
+		_, err := transaction.ExecContext(monitoringContext, `
+			INSERT INTO compaction_day (subscription_id, day, status, source_object_count, record_count, output_key, 
+			                            source_bytes, output_bytes, content_sha256, duplicate_count, dead_letter_count,
+			                            unreadable_object_count, attempts, last_error, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			ON CONFLICT (subscription_id, day) DO UPDATE SET status = $3, source_object_count = $4, record_count = $5, 
+				output_key = $6, source_bytes = $7, output_bytes = $8, content_sha256 = $9, duplicate_count = $10,
+				dead_letter_count = $11, unreadable_object_count = $12, attempts = $13, last_error = $14, updated_at = $15`,
+			compactionDay.SubscriptionId, compactionDay.Day.Format("2006-01-02"), compactionDay.Status,
+			compactionDay.SourceObjectCount, compactionDay.RecordCount, compactionDay.OutputKey, compactionDay.SourceBytes,
+			compactionDay.OutputBytes, compactionDay.ContentSha256, compactionDay.DuplicateCount,
+			compactionDay.DeadLetterCount, compactionDay.UnreadableObjectCount, compactionDay.Attempts,
+			compactionDay.LastError, compactionDay.UpdatedAt)
+
+		return err
+	})
+}
+
+// GetCompactionMonths returns the monthly roll-up ledger entries for the Subscription for the months between from and
+// to inclusive, oldest first
+func GetCompactionMonths(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) ([]models.CompactionMonth, error) {
+	var result []models.CompactionMonth
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM compaction_month WHERE subscription_id = $1 AND month >= $2 AND month <= $3 ORDER BY month`,
+		subscriptionId, from.Format("2006-01-02"), to.Format("2006-01-02"))
+
+	return result, err
+}
+
+// UpsertCompactionMonth writes the ledger entry for the month, as long as the lock of the job rolling it up is still
+// held
+func UpsertCompactionMonth(monitoringContext *monitoring.Context, lock models.CronLock, compactionMonth models.CompactionMonth) error {
+	return withCronLock(monitoringContext, lock, func(transaction *sqlx.Tx) error {
+		_, err := transaction.ExecContext(monitoringContext, `
+			INSERT INTO compaction_month (subscription_id, month, status, source_object_count, record_count, part_count,
+			                              output_prefix, source_bytes, output_bytes, duplicate_count, dead_letter_count,
+			                              unreadable_object_count, attempts, last_error, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			ON CONFLICT (subscription_id, month) DO UPDATE SET status = $3, source_object_count = $4, record_count = $5,
+				part_count = $6, output_prefix = $7, source_bytes = $8, output_bytes = $9, duplicate_count = $10,
+				dead_letter_count = $11, unreadable_object_count = $12, attempts = $13, last_error = $14, updated_at = $15`,
+			compactionMonth.SubscriptionId, compactionMonth.Month.Format("2006-01-02"), compactionMonth.Status,
+			compactionMonth.SourceObjectCount, compactionMonth.RecordCount, compactionMonth.PartCount,
+			compactionMonth.OutputPrefix, compactionMonth.SourceBytes, compactionMonth.OutputBytes,
+			compactionMonth.DuplicateCount, compactionMonth.DeadLetterCount, compactionMonth.UnreadableObjectCount,
+			compactionMonth.Attempts, compactionMonth.LastError, compactionMonth.UpdatedAt)
+
+		return err
+	})
+}
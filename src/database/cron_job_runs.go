@@ -0,0 +1,55 @@
+package db
+
+import (
+	"github.com/jmoiron/sqlx"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+)
+
+// StartCronJobRun records the run as running.  It is called once the job's lock has been acquired, so any run of the
+// job still marked as running belongs to a holder whose lease ran out, and is marked as abandoned.
+func StartCronJobRun(monitoringContext *monitoring.Context, lock models.CronLock, run models.CronJobRun) error {
+	return withCronLock(monitoringContext, lock, func(transaction *sqlx.Tx) error {
+		_, err := transaction.ExecContext(monitoringContext, `
+			UPDATE cron_job_run SET status = $1, ended_at = NOW() WHERE name = $2 AND status = $3`,
+			models.CronJobRunAbandoned, run.Name, models.CronJobRunRunning)
+		if err != nil {
+			return err
+		}
+
+		_, err = transaction.ExecContext(monitoringContext, `
+			INSERT INTO cron_job_run (id, name, host, trigger, status, started_at, summary) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			run.Id, run.Name, run.Host, run.Trigger, models.CronJobRunRunning, run.StartedAt, run.Summary)
+
+		return err
+	})
+}
+
+func FinishCronJobRun(monitoringContext *monitoring.Context, run models.CronJobRun) error {
+	_, err := dbConnection.ExecContext(monitoringContext, `
+		UPDATE cron_job_run SET status = $1, ended_at = $2, error = $3, summary = $4 WHERE id = $5`,
+		run.Status, run.EndedAt, run.Error, run.Summary, run.Id)
+
+	return err
+}
+
+// GetCronJobRuns returns the most recent runs of the job, newest first
+func GetCronJobRuns(monitoringContext *monitoring.Context, name string, limit int) ([]models.CronJobRun, error) {
+	var result []models.CronJobRun
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM cron_job_run WHERE name = $1 ORDER BY started_at DESC LIMIT $2`, name, limit)
+
+	return result, err
+}
+
+// GetLatestCronJobRuns returns the most recent run of every job which has run
+func GetLatestCronJobRuns(monitoringContext *monitoring.Context) ([]models.CronJobRun, error) {
+	var result []models.CronJobRun
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT DISTINCT ON (name) * FROM cron_job_run ORDER BY name, started_at DESC`)
+
+	return result, err
+}
@@ -2,47 +2,88 @@ package db
 
 import (
 	"database/sql"
-	"go.uber.org/zap"
-	"os"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"subscriptions/src/models"
 	"subscriptions/src/monitoring"
+	"time"
 )
 
-func AttemptToGetLock(cronName string) bool {
-	transaction, err := dbConnection.BeginTxx(monitoring.GlobalContext, &sql.TxOptions{
-		Isolation: sql.LevelSerializable,
-		ReadOnly:  false,
-	})
+// ErrCronLockLost is returned by writes fenced by a cron lock whose lease has expired or been taken by someone else
+var ErrCronLockLost = errors.New("cron lock lease has been lost")
+
+// AcquireCronLock takes the lock for the job for ttl if nobody else holds it.  The lock row is created the first time
+// a job is locked, so newly registered jobs need no migration.
+func AcquireCronLock(monitoringContext *monitoring.Context, cronName string, holder string, ttl time.Duration) (lock models.CronLock, acquired bool, err error) {
+	var fencingToken int64
+	err = dbConnection.GetContext(monitoringContext, &fencingToken, `
+		INSERT INTO cron_job_lock (name, locked_by, locked_until, fencing_token) 
+		VALUES ($1, $2, NOW() AT TIME ZONE 'UTC' + $3 * INTERVAL '1 SECOND', 1)
+		ON CONFLICT (name) DO UPDATE SET locked_by = $2, 
+			locked_until = NOW() AT TIME ZONE 'UTC' + $3 * INTERVAL '1 SECOND', 
+			fencing_token = cron_job_lock.fencing_token + 1
+		WHERE cron_job_lock.locked_until < NOW() AT TIME ZONE 'UTC'
+		RETURNING fencing_token`,
+		cronName, holder, int64(ttl.Seconds()))
+	if err == sql.ErrNoRows {
+		return models.CronLock{}, false, nil
+	}
 	if err != nil {
-		monitoring.GlobalContext.Error("Could not start transaction to get lock for cron job: "+cronName, zap.Error(err))
-		return false
+		return models.CronLock{}, false, err
 	}
 
-	var selectedName *string
-	err = transaction.Get(&selectedName, "SELECT name FROM cron_job_lock WHERE name = $1 AND locked_until < NOW() AT TIME ZONE 'UTC' FOR UPDATE NOWAIT", cronName)
+	return models.CronLock{Name: cronName, FencingToken: fencingToken}, true, nil
+}
+
+// RenewCronLock extends the lease by ttl from now, returning ErrCronLockLost if it has already run out
+func RenewCronLock(monitoringContext *monitoring.Context, lock models.CronLock, ttl time.Duration) error {
+	result, err := dbConnection.ExecContext(monitoringContext, `
+		UPDATE cron_job_lock SET locked_until = NOW() AT TIME ZONE 'UTC' + $1 * INTERVAL '1 SECOND' 
+		WHERE name = $2 AND fencing_token = $3 AND locked_until >= NOW() AT TIME ZONE 'UTC'`,
+		int64(ttl.Seconds()), lock.Name, lock.FencingToken)
 	if err != nil {
-		transaction.Commit()
-		return false
+		return err
 	}
 
-	hostname, err := os.Hostname()
+	rows, err := result.RowsAffected()
 	if err != nil {
-		hostname = "Unknown"
+		return err
 	}
 
-	_, err = transaction.Exec("UPDATE cron_job_lock SET locked_by = $1, locked_until = NOW() AT TIME ZONE 'UTC' + INTERVAL '24 HOUR' WHERE name = $2",
-		hostname, cronName)
-
-	if err != nil {
-		transaction.Commit()
-		return false
+	if rows != 1 {
+		return ErrCronLockLost
 	}
 
-	err = transaction.Commit()
+	return nil
+}
 
-	if err != nil {
-		monitoring.GlobalContext.Error("Could not end transaction on cron lock table", zap.Error(err))
-		return false
-	}
+// ReleaseCronLock ends the lease so the job can be run again straight away
+func ReleaseCronLock(monitoringContext *monitoring.Context, lock models.CronLock) error {
+	_, err := dbConnection.ExecContext(monitoringContext, `
+		UPDATE cron_job_lock SET locked_until = NOW() AT TIME ZONE 'UTC' - INTERVAL '1 SECOND' 
+		WHERE name = $1 AND fencing_token = $2`,
+		lock.Name, lock.FencingToken)
 
-	return true
+	return err
+}
+
+// withCronLock runs the writes in a transaction which holds a share lock on the cron lock row, so the lease cannot be
+// taken over until they are committed.  ErrCronLockLost is returned without running them if the lease has been lost.
+func withCronLock(monitoringContext *monitoring.Context, lock models.CronLock, writes func(transaction *sqlx.Tx) error) error {
+	return WithTransaction(monitoringContext, func(transaction *Transaction) error {
+		var name string
+		err := transaction.tx.GetContext(monitoringContext, &name, `
+			SELECT name FROM cron_job_lock 
+			WHERE name = $1 AND fencing_token = $2 AND locked_until >= NOW() AT TIME ZONE 'UTC' 
+			FOR SHARE`,
+			lock.Name, lock.FencingToken)
+		if err == sql.ErrNoRows {
+			return ErrCronLockLost
+		}
+		if err != nil {
+			return err
+		}
+
+		return writes(transaction.tx)
+	})
 }
@@ -10,12 +10,32 @@ import (
 	"regexp"
 	"strings"
 	"subscriptions/src/monitoring"
+	"sync/atomic"
 	"time"
 )
 
 var dbConnection *sqlx.DB
 
+// initialized is set once the database has been migrated, as the server starts before then
+var initialized int32
+
+// Initialize connects to the database, then migrates and seeds it
 func Initialize(username, password, database, host string, port int) error {
+	err := Connect(username, password, database, host, port)
+	if err != nil {
+		return err
+	}
+
+	migrateDatabase()
+	seedDatabase()
+	atomic.StoreInt32(&initialized, 1)
+
+	return nil
+}
+
+// Connect opens the connection used by the rest of the package, retrying until the database is up.  It leaves the
+// schema alone, so is for tests that run against a database which has already been migrated.
+func Connect(username, password, database, host string, port int) error {
 	connect := func() error {
 		monitoring.GlobalContext.Info("Attempting to connect to database",
 			zap.String("username", username),
@@ -40,7 +60,7 @@ func Initialize(username, password, database, host string, port int) error {
 		monitoring.GlobalContext.Info("Database connection established")
 		return nil
 	}
-	err := backoff.Retry(connect, &backoff.ExponentialBackOff{
+	return backoff.Retry(connect, &backoff.ExponentialBackOff{
 		InitialInterval:     100 * time.Millisecond,
 		RandomizationFactor: 0.5,
 		Multiplier:          1.2,
@@ -49,15 +69,11 @@ func Initialize(username, password, database, host string, port int) error {
 		Stop:                -1,
 		Clock:               backoff.SystemClock,
 	})
+}
 
-	if err != nil {
-		return err
-	}
-
-	migrateDatabase()
-	seedDatabase()
-
-	return nil
+// IsInitialized is for background workers which start with the server, so they can wait for the database to be ready
+func IsInitialized() bool {
+	return atomic.LoadInt32(&initialized) == 1
 }
 
 func Close() {
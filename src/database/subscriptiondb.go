@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	uuid2 "github.com/google/uuid"
 	"subscriptions/src/models"
 	"subscriptions/src/monitoring"
 )
@@ -108,11 +109,13 @@ func GetAllSubscriptionActions(monitoringContext *monitoring.Context) (*models.S
 	return list, nil
 }
 
-func GetSubscriptionsPage(monitoringContext *monitoring.Context, pageSize int, offset int) ([]models.Subscription, error) {
+// GetSubscriptionsPageAfter returns the next page of Subscriptions ordered by id, starting after afterId.  Pass
+// uuid.Nil to get the first page.
+func GetSubscriptionsPageAfter(monitoringContext *monitoring.Context, pageSize int, afterId uuid2.UUID) ([]models.Subscription, error) {
 	var result []models.Subscription
 
 	err := dbConnection.SelectContext(monitoringContext, &result,
-		fmt.Sprintf("SELECT * FROM subscription LIMIT %d OFFSET %d", pageSize, offset))
+		"SELECT * FROM subscription WHERE id > $1 ORDER BY id LIMIT $2", afterId, pageSize)
 
 	return result, err
 }
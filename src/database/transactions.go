@@ -0,0 +1,28 @@
+package db
+
+import (
+	"github.com/jmoiron/sqlx"
+	"subscriptions/src/monitoring"
+)
+
+// Transaction is handed to the statements run by WithTransaction.  Functions in this package which take one run
+// their statements in it, so services can make several changes which are committed together or not at all.
+type Transaction struct {
+	tx *sqlx.Tx
+}
+
+// WithTransaction runs the statements in a single transaction, which is committed if they return nil and rolled back
+// otherwise
+func WithTransaction(monitoringContext *monitoring.Context, statements func(transaction *Transaction) error) error {
+	tx, err := dbConnection.BeginTxx(monitoringContext, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := statements(&Transaction{tx: tx}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"database/sql"
+	uuid2 "github.com/google/uuid"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+)
+
+func GetUsageQuery(monitoringContext *monitoring.Context, usageQueryId uuid2.UUID) (exists bool, entity models.UsageQuery, err error) {
+	var result models.UsageQuery
+
+	err = dbConnection.GetContext(monitoringContext, &result, `
+		SELECT * FROM usage_query WHERE id = $1`, usageQueryId)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, result, nil
+		}
+
+		return false, result, err
+	}
+
+	return true, result, nil
+}
+
+// GetPendingUsageQueries returns the usage queries across every subscription which are running, or which are due
+// another attempt, oldest first
+func GetPendingUsageQueries(monitoringContext *monitoring.Context, limit int) ([]models.UsageQuery, error) {
+	var result []models.UsageQuery
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM usage_query
+		WHERE status = $1 OR (status = $2 AND next_attempt_at <= NOW())
+		ORDER BY requested_at LIMIT $3`,
+		models.UsageQueryPending, models.UsageQueryRetrying, limit)
+
+	return result, err
+}
+
+func InsertUsageQuery(monitoringContext *monitoring.Context, usageQuery models.UsageQuery) error {
+	_, err := dbConnection.ExecContext(monitoringContext, `
+		INSERT INTO usage_query (id, subscription_id, starts_at, ends_at, requested_at, athena_query_id, status, attempts,
+			next_attempt_at, completed_at, failed_at, failure_reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		usageQuery.Id, usageQuery.SubscriptionId, usageQuery.StartsAt, usageQuery.EndsAt, usageQuery.RequestedAt,
+		usageQuery.AthenaQueryId, usageQuery.Status, usageQuery.Attempts, usageQuery.NextAttemptAt, usageQuery.CompletedAt,
+		usageQuery.FailedAt, usageQuery.FailureReason)
+
+	return err
+}
+
+// LockPendingUsageQuery locks the usage query for the rest of the transaction if it is still pending and due to be
+// checked on, skipping it if another transaction already has it locked like LockPendingUsageReportInstance
+func LockPendingUsageQuery(monitoringContext *monitoring.Context, transaction *Transaction, usageQueryId uuid2.UUID) (locked bool, entity models.UsageQuery, err error) {
+	var result models.UsageQuery
+
+	err = transaction.tx.GetContext(monitoringContext, &result, `
+		SELECT * FROM usage_query
+		WHERE id = $1 AND (status = $2 OR (status = $3 AND next_attempt_at <= NOW()))
+		FOR UPDATE SKIP LOCKED`,
+		usageQueryId, models.UsageQueryPending, models.UsageQueryRetrying)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, result, nil
+		}
+
+		return false, result, err
+	}
+
+	return true, result, nil
+}
+
+func UpdateUsageQuery(monitoringContext *monitoring.Context, transaction *Transaction, usageQuery models.UsageQuery) error {
+	_, err := transaction.tx.ExecContext(monitoringContext, `
+		UPDATE usage_query SET athena_query_id = $1, status = $2, attempts = $3, next_attempt_at = $4, completed_at = $5,
+			failed_at = $6, failure_reason = $7
+		WHERE id = $8`,
+		usageQuery.AthenaQueryId, usageQuery.Status, usageQuery.Attempts, usageQuery.NextAttemptAt, usageQuery.CompletedAt,
+		usageQuery.FailedAt, usageQuery.FailureReason, usageQuery.Id)
+
+	return err
+}
+
+func GetUsageQueryProducts(monitoringContext *monitoring.Context, usageQueryId uuid2.UUID) ([]models.UsageQueryProduct, error) {
+	var result []models.UsageQueryProduct
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM usage_query_product WHERE usage_query_id = $1 ORDER BY product`, usageQueryId)
+
+	return result, err
+}
+
+func InsertUsageQueryProduct(monitoringContext *monitoring.Context, transaction *Transaction, usageQueryProduct models.UsageQueryProduct) error {
+	_, err := transaction.tx.ExecContext(monitoringContext, `
+		INSERT INTO usage_query_product (usage_query_id, product, value)
+		VALUES ($1, $2, $3)`,
+		usageQueryProduct.UsageQueryId, usageQueryProduct.Product, usageQueryProduct.Value)
+
+	return err
+}
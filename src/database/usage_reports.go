@@ -33,6 +33,26 @@ func GetUsageReport(monitoringContext *monitoring.Context, usageReportId uuid2.U
 	return true, result, nil
 }
 
+// GetUsageReportForInstance returns the usage report the instance was requested for
+func GetUsageReportForInstance(monitoringContext *monitoring.Context, usageReportInstanceId uuid2.UUID) (exists bool, entity models.UsageReport, err error) {
+	var result models.UsageReport
+
+	err = dbConnection.GetContext(monitoringContext, &result, `
+		SELECT usage_report.* FROM usage_report
+		JOIN usage_report_instance ON usage_report_instance.usage_report_id = usage_report.id
+		WHERE usage_report_instance.id = $1`, usageReportInstanceId)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, result, nil
+		}
+
+		return false, result, err
+	}
+
+	return true, result, nil
+}
+
 func InsertUsageReport(monitoringContext *monitoring.Context, usageReport models.UsageReport) error {
 	_, err := dbConnection.ExecContext(monitoringContext, `
 		INSERT INTO usage_report (id, subscription_id, year, month) VALUES ($1, $2, $3, $4)`,
@@ -50,20 +70,63 @@ func GetUsageReportInstances(monitoringContext *monitoring.Context, usageReportI
 	return result, err
 }
 
+// GetPendingUsageReportInstances returns the instances across every usage report whose query is running, or which
+// are due another attempt, oldest first
+func GetPendingUsageReportInstances(monitoringContext *monitoring.Context, limit int) ([]models.UsageReportInstance, error) {
+	var result []models.UsageReportInstance
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM usage_report_instance 
+		WHERE status = $1 OR (status = $2 AND next_attempt_at <= NOW()) 
+		ORDER BY requested_at LIMIT $3`,
+		models.UsageQueryPending, models.UsageQueryRetrying, limit)
+
+	return result, err
+}
+
 func InsertUsageReportInstance(monitoringContext *monitoring.Context, usageReportInstance models.UsageReportInstance) error {
 	_, err := dbConnection.ExecContext(monitoringContext, `
-		INSERT INTO usage_report_instance (id, usage_report_id, requested_at, athena_query_id, completed_at) 
-		VALUES ($1, $2, $3, $4, $5)`,
-		usageReportInstance.Id, usageReportInstance.UsageReportId, usageReportInstance.RequestedAt, usageReportInstance.AthenaQueryId, usageReportInstance.CompletedAt)
+		INSERT INTO usage_report_instance (id, usage_report_id, requested_at, athena_query_id, status, attempts, 
+			next_attempt_at, completed_at, failed_at, failure_reason, breakdowns) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		usageReportInstance.Id, usageReportInstance.UsageReportId, usageReportInstance.RequestedAt, usageReportInstance.AthenaQueryId,
+		usageReportInstance.Status, usageReportInstance.Attempts, usageReportInstance.NextAttemptAt, usageReportInstance.CompletedAt,
+		usageReportInstance.FailedAt, usageReportInstance.FailureReason, usageReportInstance.Breakdowns)
 
 	return err
 }
 
-func UpdateUsageReportInstance(monitoringContext *monitoring.Context, usageReportInstance models.UsageReportInstance) error {
-	_, err := dbConnection.ExecContext(monitoringContext, `
-		UPDATE usage_report_instance SET usage_report_id = $1, requested_at = $2, athena_query_id = $3, completed_at = $4  
-		WHERE id = $5`,
-		usageReportInstance.UsageReportId, usageReportInstance.RequestedAt, usageReportInstance.AthenaQueryId, usageReportInstance.CompletedAt, usageReportInstance.Id)
+// LockPendingUsageReportInstance locks the instance for the rest of the transaction if it is still pending and due
+// to be checked on.  Instances already locked by another transaction are skipped rather than waited for, returning
+// false, so pollers on other pods move on to the next instance.
+func LockPendingUsageReportInstance(monitoringContext *monitoring.Context, transaction *Transaction, usageReportInstanceId uuid2.UUID) (locked bool, entity models.UsageReportInstance, err error) {
+	var result models.UsageReportInstance
+
+	err = transaction.tx.GetContext(monitoringContext, &result, `
+		SELECT * FROM usage_report_instance 
+		WHERE id = $1 AND (status = $2 OR (status = $3 AND next_attempt_at <= NOW())) 
+		FOR UPDATE SKIP LOCKED`,
+		usageReportInstanceId, models.UsageQueryPending, models.UsageQueryRetrying)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, result, nil
+		}
+
+		return false, result, err
+	}
+
+	return true, result, nil
+}
+
+func UpdateUsageReportInstance(monitoringContext *monitoring.Context, transaction *Transaction, usageReportInstance models.UsageReportInstance) error {
+	_, err := transaction.tx.ExecContext(monitoringContext, `
+		UPDATE usage_report_instance SET usage_report_id = $1, requested_at = $2, athena_query_id = $3, status = $4, 
+			attempts = $5, next_attempt_at = $6, completed_at = $7, failed_at = $8, failure_reason = $9 
+		WHERE id = $10`,
+		usageReportInstance.UsageReportId, usageReportInstance.RequestedAt, usageReportInstance.AthenaQueryId,
+		usageReportInstance.Status, usageReportInstance.Attempts, usageReportInstance.NextAttemptAt, usageReportInstance.CompletedAt,
+		usageReportInstance.FailedAt, usageReportInstance.FailureReason, usageReportInstance.Id)
 
 	return err
 }
@@ -72,16 +135,146 @@ func GetUsageReportInstanceProducts(monitoringContext *monitoring.Context, usage
 	var result []models.UsageReportInstanceProduct
 
 	err := dbConnection.SelectContext(monitoringContext, &result, `
-		SELECT * FROM usage_report_instance_product WHERE usage_report_instance_id = $1`, usageReportInstance)
+		SELECT * FROM usage_report_instance_product WHERE usage_report_instance_id = $1 ORDER BY product`, usageReportInstance)
 
 	return result, err
 }
 
-func InsertUsageReportInstanceProduct(monitoringContext *monitoring.Context, usageReportInstanceProduct models.UsageReportInstanceProduct) error {
-	_, err := dbConnection.ExecContext(monitoringContext, `
+func InsertUsageReportInstanceProduct(monitoringContext *monitoring.Context, transaction *Transaction, usageReportInstanceProduct models.UsageReportInstanceProduct) error {
+	_, err := transaction.tx.ExecContext(monitoringContext, `
 		INSERT INTO usage_report_instance_product (usage_report_instance_id, product, value) 
 		VALUES ($1, $2, $3)`,
 		usageReportInstanceProduct.UsageReportInstanceId, usageReportInstanceProduct.Product, usageReportInstanceProduct.Value)
 
 	return err
 }
+
+func GetUsageReportInstanceBreakdowns(monitoringContext *monitoring.Context, usageReportInstance uuid2.UUID) ([]models.UsageReportInstanceBreakdown, error) {
+	var result []models.UsageReportInstanceBreakdown
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM usage_report_instance_breakdown WHERE usage_report_instance_id = $1`, usageReportInstance)
+
+	return result, err
+}
+
+func InsertUsageReportInstanceBreakdown(monitoringContext *monitoring.Context, transaction *Transaction, usageReportInstanceBreakdown models.UsageReportInstanceBreakdown) error {
+	_, err := transaction.tx.ExecContext(monitoringContext, `
+		INSERT INTO usage_report_instance_breakdown (usage_report_instance_id, breakdown, product, android_id, method, path, value) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		usageReportInstanceBreakdown.UsageReportInstanceId, usageReportInstanceBreakdown.Breakdown, usageReportInstanceBreakdown.Product,
+		usageReportInstanceBreakdown.AndroidId, usageReportInstanceBreakdown.Method, usageReportInstanceBreakdown.Path,
+		usageReportInstanceBreakdown.Value)
+
+	return err
+}
+
+func GetUsageReportInstanceHours(monitoringContext *monitoring.Context, usageReportInstance uuid2.UUID) ([]models.UsageReportInstanceHour, error) {
+	var result []models.UsageReportInstanceHour
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM usage_report_instance_hour WHERE usage_report_instance_id = $1 ORDER BY hour, product`, usageReportInstance)
+
+	return result, err
+}
+
+// hourInsertBatchSize keeps each insert well under Postgres' limit on the number of parameters in a statement
+const hourInsertBatchSize = 1000
+
+// InsertUsageReportInstanceHours inserts the hours in batches, as a month has up to 744 hours for each product
+func InsertUsageReportInstanceHours(monitoringContext *monitoring.Context, transaction *Transaction, usageReportInstanceHours []models.UsageReportInstanceHour) error {
+	for start := 0; start < len(usageReportInstanceHours); start += hourInsertBatchSize {
+		end := start + hourInsertBatchSize
+		if end > len(usageReportInstanceHours) {
+			end = len(usageReportInstanceHours)
+		}
+
+		_, err := transaction.tx.NamedExecContext(monitoringContext, `
+			INSERT INTO usage_report_instance_hour (usage_report_instance_id, product, hour, value) 
+			VALUES (:usage_report_instance_id, :product, :hour, :value)`,
+			usageReportInstanceHours[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetUsageReportExport(monitoringContext *monitoring.Context, usageReportExportId uuid2.UUID) (exists bool, entity models.UsageReportExport, err error) {
+	var result models.UsageReportExport
+
+	err = dbConnection.GetContext(monitoringContext, &result, `
+		SELECT * FROM usage_report_export WHERE id = $1`, usageReportExportId)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, result, nil
+		}
+
+		return false, result, err
+	}
+
+	return true, result, nil
+}
+
+// GetPendingUsageReportExports returns the raw exports across every usage report whose query is running, or which
+// are due another attempt, oldest first
+func GetPendingUsageReportExports(monitoringContext *monitoring.Context, limit int) ([]models.UsageReportExport, error) {
+	var result []models.UsageReportExport
+
+	err := dbConnection.SelectContext(monitoringContext, &result, `
+		SELECT * FROM usage_report_export
+		WHERE status = $1 OR (status = $2 AND next_attempt_at <= NOW())
+		ORDER BY requested_at LIMIT $3`,
+		models.UsageQueryPending, models.UsageQueryRetrying, limit)
+
+	return result, err
+}
+
+func InsertUsageReportExport(monitoringContext *monitoring.Context, usageReportExport models.UsageReportExport) error {
+	_, err := dbConnection.ExecContext(monitoringContext, `
+		INSERT INTO usage_report_export (id, usage_report_instance_id, format, level, object_key, requested_at,
+			athena_query_id, status, attempts, next_attempt_at, completed_at, failed_at, failure_reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		usageReportExport.Id, usageReportExport.UsageReportInstanceId, usageReportExport.Format, usageReportExport.Level,
+		usageReportExport.ObjectKey, usageReportExport.RequestedAt, usageReportExport.AthenaQueryId, usageReportExport.Status,
+		usageReportExport.Attempts, usageReportExport.NextAttemptAt, usageReportExport.CompletedAt, usageReportExport.FailedAt,
+		usageReportExport.FailureReason)
+
+	return err
+}
+
+// LockPendingUsageReportExport locks the export for the rest of the transaction if it is still pending and due to be
+// checked on, skipping it if another transaction already has it locked like LockPendingUsageReportInstance
+func LockPendingUsageReportExport(monitoringContext *monitoring.Context, transaction *Transaction, usageReportExportId uuid2.UUID) (locked bool, entity models.UsageReportExport, err error) {
+	var result models.UsageReportExport
+
+	err = transaction.tx.GetContext(monitoringContext, &result, `
+		SELECT * FROM usage_report_export
+		WHERE id = $1 AND (status = $2 OR (status = $3 AND next_attempt_at <= NOW()))
+		FOR UPDATE SKIP LOCKED`,
+		usageReportExportId, models.UsageQueryPending, models.UsageQueryRetrying)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, result, nil
+		}
+
+		return false, result, err
+	}
+
+	return true, result, nil
+}
+
+func UpdateUsageReportExport(monitoringContext *monitoring.Context, transaction *Transaction, usageReportExport models.UsageReportExport) error {
+	_, err := transaction.tx.ExecContext(monitoringContext, `
+		UPDATE usage_report_export SET athena_query_id = $1, status = $2, attempts = $3, next_attempt_at = $4,
+			completed_at = $5, failed_at = $6, failure_reason = $7
+		WHERE id = $8`,
+		usageReportExport.AthenaQueryId, usageReportExport.Status, usageReportExport.Attempts,
+		usageReportExport.NextAttemptAt, usageReportExport.CompletedAt, usageReportExport.FailedAt,
+		usageReportExport.FailureReason, usageReportExport.Id)
+
+	return err
+}
@@ -0,0 +1,85 @@
+package ingestion
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	uuid2 "github.com/google/uuid"
+	"go.uber.org/zap"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+	"subscriptions/src/utils"
+	"time"
+)
+
+// WriteAccessLogs writes one gzip object of JSON lines per day under the {subscriptionId}/{yyyy/MM/dd}/ prefix,
+// which is where the compaction cron and the Athena tables expect to find them.
+func WriteAccessLogs(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, records []models.AccessLogRecord) error {
+	for day, dayRecords := range groupByDay(records) {
+		if err := writeDayObject(monitoringContext, subscriptionId, day, dayRecords); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeDayObject(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, day time.Time, records []models.AccessLogRecord) error {
+	key := fmt.Sprintf("%s/%s/%s.gz", subscriptionId.String(), day.Format("2006/01/02"), uuid2.New().String())
+
+	gzipped, err := gzipJsonLines(records)
+	if err != nil {
+		monitoringContext.Error("Could not gzip access log records",
+			zap.Error(err), zap.String("subscriptionId", subscriptionId.String()), zap.Time("day", day))
+		return err
+	}
+
+	err = storage.AccessLogs.Put(monitoringContext, key, bytes.NewReader(gzipped), nil)
+	if err != nil {
+		monitoringContext.Error("Could not write access log object",
+			zap.Error(err), zap.String("subscriptionId", subscriptionId.String()), zap.String("key", key))
+		return err
+	}
+
+	return nil
+}
+
+func groupByDay(records []models.AccessLogRecord) map[time.Time][]models.AccessLogRecord {
+	days := make(map[time.Time][]models.AccessLogRecord)
+	for _, record := range records {
+		day := utils.ToDay(time.Unix(record.OccurredAt, 0).UTC())
+		days[day] = append(days[day], record)
+	}
+
+	return days
+}
+
+// gzipJsonLines matches the format of the objects written by the gateway: one JSON record per line and no trailing
+// newline, as the compaction cron adds its own between objects.
+func gzipJsonLines(records []models.AccessLogRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	zipWriter := gzip.NewWriter(&buf)
+
+	for i, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			line = append([]byte("\n"), line...)
+		}
+
+		if _, err = zipWriter.Write(line); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,381 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"github.com/cenkalti/backoff/v4"
+	uuid2 "github.com/google/uuid"
+	"go.uber.org/zap"
+	"subscriptions/src/config"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"sync"
+	"time"
+)
+
+const bufferCheckInterval = 1 * time.Second
+
+// Used when the profile leaves the matching BucketConfig setting out
+const (
+	defaultBufferMaxEvents     = 1000
+	defaultBufferMaxBytes      = 1024 * 1024
+	defaultBufferFlushInterval = 5 * time.Second
+)
+
+// A buffer which could not be written is retried after bufferRetryBackoff, doubling for each failure after that up to
+// bufferMaxRetryBackoff, so an unavailable bucket is not hammered with the same records every check
+const (
+	bufferRetryBackoff    = 1 * time.Second
+	bufferMaxRetryBackoff = 1 * time.Minute
+)
+
+// rejectedRecordsMetric counts the records turned away because too much was already held back waiting to be retried
+const rejectedRecordsMetric = "Custom/AccessLogBuffer/RejectedRecords"
+
+// ErrBufferFull is returned by BufferAccessLogs when more than BufferMaxHeldBytes is held waiting to be written, which
+// only happens while writes to the access log bucket are failing
+var ErrBufferFull = errors.New("too many access logs are waiting to be written")
+
+type bufferKey struct {
+	subscriptionId uuid2.UUID
+	day            time.Time
+}
+
+type dayBuffer struct {
+	records       []models.AccessLogRecord
+	bytes         int
+	createdAt     time.Time
+	failures      int
+	nextAttemptAt time.Time
+}
+
+type bufferedWriter struct {
+	mutex         sync.Mutex
+	buffers       map[bufferKey]*dayBuffer
+	maxEvents     int
+	maxBytes      int
+	maxHeldBytes  int
+	flushInterval time.Duration
+	wake          chan struct{}
+	flushes       chan flush
+	stop          chan struct{}
+	done          sync.WaitGroup
+	// held is the size of every record added and not yet written, whether it is waiting in buffers or being flushed
+	held     int
+	stopping bool
+}
+
+type flush struct {
+	key    bufferKey
+	buffer *dayBuffer
+}
+
+// writerMutex guards writer, which request goroutines read while the server is starting and stopping
+var (
+	writerMutex sync.RWMutex
+	writer      *bufferedWriter
+)
+
+func getWriter() *bufferedWriter {
+	writerMutex.RLock()
+	defer writerMutex.RUnlock()
+
+	return writer
+}
+
+// StartBufferedWriter groups incoming access log records per Subscription and day, writing each group to the access
+// log bucket as a single object once it reaches the size thresholds in BucketConfig or has been held for the flush
+// interval.  This keeps the number of small objects the compaction cron has to read down.  Records which could not be
+// written are held back and retried with a backoff, and new records are turned away while more than
+// BufferMaxHeldBytes is held.
+func StartBufferedWriter() {
+	bucketConfig := config.GetConfig().BucketConfig
+
+	maxEvents := bucketConfig.BufferMaxEvents
+	if maxEvents <= 0 {
+		maxEvents = defaultBufferMaxEvents
+	}
+
+	maxBytes := bucketConfig.BufferMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBufferMaxBytes
+	}
+
+	flushInterval := time.Duration(bucketConfig.BufferFlushIntervalMs) * time.Millisecond
+	if flushInterval <= 0 {
+		flushInterval = defaultBufferFlushInterval
+	}
+
+	maxHeldBytes := bucketConfig.BufferMaxHeldBytes
+	if maxHeldBytes <= 0 {
+		maxHeldBytes = 10 * maxBytes
+	}
+
+	started := &bufferedWriter{
+		buffers:       make(map[bufferKey]*dayBuffer),
+		maxEvents:     maxEvents,
+		maxBytes:      maxBytes,
+		maxHeldBytes:  maxHeldBytes,
+		flushInterval: flushInterval,
+		wake:          make(chan struct{}, 1),
+		flushes:       make(chan flush),
+		stop:          make(chan struct{}),
+	}
+
+	started.done.Add(2)
+	go started.queueFlushesWhenDue()
+	go started.writeFlushes()
+
+	writerMutex.Lock()
+	writer = started
+	writerMutex.Unlock()
+
+	monitoring.GlobalContext.Info("Started buffered access log writer",
+		zap.Int("maxEvents", started.maxEvents),
+		zap.Int("maxBytes", started.maxBytes),
+		zap.Int("maxHeldBytes", started.maxHeldBytes),
+		zap.Duration("flushInterval", started.flushInterval))
+}
+
+// StopBufferedWriter writes out everything still held in memory, giving up on whatever is left once ctx is done.
+// Records which arrive once it has been called are written straight away rather than buffered.
+func StopBufferedWriter(ctx context.Context) {
+	w := getWriter()
+	if w == nil || !w.startStopping() {
+		return
+	}
+
+	monitoring.GlobalContext.Info("Draining buffered access log writer")
+	close(w.stop)
+
+	drained := make(chan struct{})
+	go func() {
+		w.done.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		monitoring.GlobalContext.Error("Buffered access logs were not drained before shutdown deadline, they have been lost",
+			zap.Int("heldBytes", w.heldBytes()))
+		return
+	}
+
+	// Anything left over failed to write during the drain, so make a last few attempts before giving up on it
+	for key, buffer := range w.buffers {
+		write := func() error {
+			return writeDayObject(monitoring.GlobalContext, key.subscriptionId, key.day, buffer.records)
+		}
+
+		err := backoff.Retry(write, backoff.WithContext(&backoff.ExponentialBackOff{
+			InitialInterval:     100 * time.Millisecond,
+			RandomizationFactor: 0.5,
+			Multiplier:          1.2,
+			MaxInterval:         1 * time.Second,
+			MaxElapsedTime:      5 * time.Second,
+			Stop:                -1,
+			Clock:               backoff.SystemClock,
+		}, ctx))
+		if err != nil {
+			monitoring.GlobalContext.Error("Could not write buffered access logs while draining, they have been lost",
+				zap.Error(err), zap.String("subscriptionId", key.subscriptionId.String()),
+				zap.Time("day", key.day), zap.Int("records", len(buffer.records)))
+		}
+	}
+
+	monitoring.GlobalContext.Info("Drained buffered access log writer")
+}
+
+func (w *bufferedWriter) heldBytes() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.held
+}
+
+// startStopping stops any more records being added, returning false if the writer was already stopping
+func (w *bufferedWriter) startStopping() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopping {
+		return false
+	}
+
+	w.stopping = true
+	return true
+}
+
+// BufferAccessLogs adds the records to the in memory buffers.  They are written to the access log bucket
+// asynchronously, falling back to writing immediately if the buffered writer has not been started or is stopping.
+// ErrBufferFull is returned rather than holding any more while writes are failing.
+func BufferAccessLogs(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, records []models.AccessLogRecord) error {
+	w := getWriter()
+	if w == nil {
+		return WriteAccessLogs(monitoringContext, subscriptionId, records)
+	}
+
+	added, err := w.add(subscriptionId, records)
+	if err != nil || added {
+		return err
+	}
+
+	return WriteAccessLogs(monitoringContext, subscriptionId, records)
+}
+
+// add returns false without adding the records if the writer is stopping
+func (w *bufferedWriter) add(subscriptionId uuid2.UUID, records []models.AccessLogRecord) (bool, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopping {
+		return false, nil
+	}
+
+	size := 0
+	for _, record := range records {
+		size += approximateSize(record)
+	}
+
+	if w.held+size > w.maxHeldBytes {
+		monitoring.GlobalContext.Error("Too many buffered access logs are waiting to be written, rejecting more",
+			zap.String("subscriptionId", subscriptionId.String()), zap.Int("records", len(records)),
+			zap.Int("heldBytes", w.held), zap.Int("maxHeldBytes", w.maxHeldBytes))
+		monitoring.GlobalContext.NewRelic.RecordCustomMetric(rejectedRecordsMetric, float64(len(records)))
+		return false, ErrBufferFull
+	}
+
+	w.held += size
+
+	full := false
+	for day, dayRecords := range groupByDay(records) {
+		key := bufferKey{subscriptionId: subscriptionId, day: day}
+
+		buffer, exists := w.buffers[key]
+		if !exists {
+			buffer = &dayBuffer{createdAt: time.Now()}
+			w.buffers[key] = buffer
+		}
+
+		for _, record := range dayRecords {
+			buffer.records = append(buffer.records, record)
+			buffer.bytes += approximateSize(record)
+		}
+
+		full = full || w.isFull(buffer)
+	}
+
+	if full {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return true, nil
+}
+
+func (w *bufferedWriter) isFull(buffer *dayBuffer) bool {
+	return len(buffer.records) >= w.maxEvents || buffer.bytes >= w.maxBytes
+}
+
+func (w *bufferedWriter) queueFlushesWhenDue() {
+	defer w.done.Done()
+
+	ticker := time.NewTicker(bufferCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.queueFlushes(false)
+		case <-w.wake:
+			w.queueFlushes(false)
+		case <-w.stop:
+			w.queueFlushes(true)
+			close(w.flushes)
+			return
+		}
+	}
+}
+
+func (w *bufferedWriter) queueFlushes(all bool) {
+	w.mutex.Lock()
+	var due []flush
+	for key, buffer := range w.buffers {
+		if !all && time.Now().Before(buffer.nextAttemptAt) {
+			continue
+		}
+
+		if all || w.isFull(buffer) || time.Since(buffer.createdAt) >= w.flushInterval {
+			delete(w.buffers, key)
+			due = append(due, flush{key: key, buffer: buffer})
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, f := range due {
+		w.flushes <- f
+	}
+}
+
+func (w *bufferedWriter) writeFlushes() {
+	defer w.done.Done()
+
+	for f := range w.flushes {
+		err := writeDayObject(monitoring.GlobalContext, f.key.subscriptionId, f.key.day, f.buffer.records)
+		if err != nil {
+			monitoring.GlobalContext.Error("Could not write buffered access logs, they will be retried",
+				zap.Error(err), zap.String("subscriptionId", f.key.subscriptionId.String()),
+				zap.Time("day", f.key.day), zap.Int("records", len(f.buffer.records)))
+			w.requeue(f)
+			continue
+		}
+
+		w.mutex.Lock()
+		w.held -= f.buffer.bytes
+		w.mutex.Unlock()
+	}
+}
+
+// requeue puts the records from a failed flush back in front of any received since, to be retried once the backoff
+// for the number of failures has passed.  They still count towards what is held, so an outage turns new records away
+// rather than growing the buffers until the pod runs out of memory.
+func (w *bufferedWriter) requeue(f flush) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	f.buffer.failures++
+	f.buffer.nextAttemptAt = time.Now().Add(retryBackoff(f.buffer.failures))
+
+	buffer, exists := w.buffers[f.key]
+	if !exists {
+		w.buffers[f.key] = f.buffer
+		return
+	}
+
+	buffer.records = append(f.buffer.records, buffer.records...)
+	buffer.bytes += f.buffer.bytes
+	buffer.createdAt = f.buffer.createdAt
+	buffer.failures = f.buffer.failures
+	buffer.nextAttemptAt = f.buffer.nextAttemptAt
+}
+
+func retryBackoff(failures int) time.Duration {
+	wait := bufferRetryBackoff
+	for i := 1; i < failures && wait < bufferMaxRetryBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > bufferMaxRetryBackoff {
+		return bufferMaxRetryBackoff
+	}
+
+	return wait
+}
+
+// approximateSize estimates the length of the record's JSON line without having to marshal it
+func approximateSize(record models.AccessLogRecord) int {
+	return 150 + len(record.Product) + len(record.Method) + len(record.Path) + len(record.AndroidId)
+}
@@ -0,0 +1,31 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	uuid2 "github.com/google/uuid"
+	"subscriptions/src/models"
+)
+
+// ValidateAccessLogRecord checks that a record has every field the Athena table and compaction cron rely on, and that
+// it belongs to the given Subscription.
+func ValidateAccessLogRecord(record models.AccessLogRecord, subscriptionId uuid2.UUID) error {
+	if record.Id == uuid2.Nil {
+		return errors.New("access log record has no Id")
+	}
+
+	if record.OccurredAt <= 0 {
+		return fmt.Errorf("access log record %s has no OccurredAt", record.Id)
+	}
+
+	if record.Product == "" || record.Method == "" || record.Path == "" || record.AndroidId == "" {
+		return fmt.Errorf("access log record %s is missing a Product, Method, Path or AndroidId", record.Id)
+	}
+
+	if record.SubscriptionId != subscriptionId {
+		return fmt.Errorf("access log record %s belongs to Subscription %s, not %s",
+			record.Id, record.SubscriptionId, subscriptionId)
+	}
+
+	return nil
+}
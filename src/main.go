@@ -15,8 +15,12 @@ import (
 	"subscriptions/src/config"
 	"subscriptions/src/cron"
 	db "subscriptions/src/database"
+	"subscriptions/src/ingestion"
 	"subscriptions/src/monitoring"
+	"subscriptions/src/services"
+	"subscriptions/src/storage"
 	"subscriptions/src/utils"
+	"syscall"
 	"time"
 )
 
@@ -39,8 +43,12 @@ func startServer(ctx context.Context) {
 	go setupDatabase()
 	defer db.Close()
 
-	cron.StartCronJobs()
 	aws.SetupAWS()
+	storage.SetupStorage()
+	services.SetupUsageQueries()
+	services.StartUsageReportPoller()
+	ingestion.StartBufferedWriter()
+	cron.StartCronJobs()
 
 	monitoring.GlobalContext.Info("Starting Server",
 		zap.String("profile", config.GetProfileName()),
@@ -50,24 +58,28 @@ func startServer(ctx context.Context) {
 	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{StackSize: 1 << 10, LogLevel: log.ERROR}))
 	api.RegisterHandlers(e, api.Implementation)
 
-	if config.GetConfig().Testing {
-		e.Router().Add("POST", "/cron", cron.ForceCronJob)
-	}
-
 	go func() {
 		if err := e.Start(":" + strconv.Itoa(activeConfig.Server.Port)); err != nil && err != http.ErrServerClosed {
 			monitoring.GlobalContext.Fatal("Shutting down Server")
 		}
 	}()
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Kubernetes sends SIGTERM when it stops the pod, and os.Interrupt covers running locally
+	quit, stopListening := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopListening()
+	<-quit.Done()
+	monitoring.GlobalContext.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(activeConfig.Server.ShutdownTimeoutSeconds)*time.Second)
 	defer cancel()
-	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		monitoring.GlobalContext.Error("Could not shut down Server cleanly", zap.Error(err))
 	}
+
+	// Access logs are drained first as they are lost with the pod, whereas cron jobs and polls are picked up again
+	ingestion.StopBufferedWriter(shutdownCtx)
+	cron.StopCronJobs(shutdownCtx)
+	services.StopUsageReportPoller(shutdownCtx)
 }
 
 func setupDatabase() {
@@ -0,0 +1,15 @@
+package models
+
+import (
+	uuid2 "github.com/google/uuid"
+)
+
+type AccessLogRecord struct {
+	Id             uuid2.UUID
+	OccurredAt     int64
+	Product        string
+	Method         string
+	Path           string
+	AndroidId      string
+	SubscriptionId uuid2.UUID
+}
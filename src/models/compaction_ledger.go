@@ -0,0 +1,50 @@
+package models
+
+import (
+	uuid2 "github.com/google/uuid"
+	"time"
+)
+
+type CompactionStatus string
+
+const (
+	CompactionSucceeded          CompactionStatus = "succeeded"
+	CompactionFailed             CompactionStatus = "failed"
+	CompactionVerificationFailed CompactionStatus = "verification_failed"
+)
+
+type CompactionDay struct {
+	SubscriptionId        uuid2.UUID
+	Day                   time.Time
+	Status                CompactionStatus
+	SourceObjectCount     int
+	RecordCount           int64
+	OutputKey             *string
+	SourceBytes           int64
+	OutputBytes           int64
+	ContentSha256         *string
+	DuplicateCount        int64
+	DeadLetterCount       int64
+	UnreadableObjectCount int
+	Attempts              int
+	LastError             *string
+	UpdatedAt             time.Time
+}
+
+type CompactionMonth struct {
+	SubscriptionId        uuid2.UUID
+	Month                 time.Time
+	Status                CompactionStatus
+	SourceObjectCount     int
+	RecordCount           int64
+	PartCount             int
+	OutputPrefix          *string
+	SourceBytes           int64
+	OutputBytes           int64
+	DuplicateCount        int64
+	DeadLetterCount       int64
+	UnreadableObjectCount int
+	Attempts              int
+	LastError             *string
+	UpdatedAt             time.Time
+}
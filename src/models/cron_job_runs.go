@@ -0,0 +1,62 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	uuid2 "github.com/google/uuid"
+	"time"
+)
+
+type CronJobRunStatus string
+
+const (
+	CronJobRunRunning   CronJobRunStatus = "running"
+	CronJobRunSucceeded CronJobRunStatus = "succeeded"
+	CronJobRunFailed    CronJobRunStatus = "failed"
+	CronJobRunTimedOut  CronJobRunStatus = "timed_out"
+	// CronJobRunCancelled is a run which was stopped because the pod running it was shutting down
+	CronJobRunCancelled CronJobRunStatus = "cancelled"
+	// CronJobRunAbandoned is a run which was still running after its lock lease ran out, normally because the pod
+	// running it died
+	CronJobRunAbandoned CronJobRunStatus = "abandoned"
+)
+
+type CronJobRunTrigger string
+
+const (
+	CronJobRunScheduled CronJobRunTrigger = "schedule"
+	CronJobRunManual    CronJobRunTrigger = "manual"
+)
+
+type CronJobRun struct {
+	Id        uuid2.UUID
+	Name      string
+	Host      string
+	Trigger   CronJobRunTrigger
+	Status    CronJobRunStatus
+	StartedAt time.Time
+	EndedAt   *time.Time
+	Error     *string
+	Summary   CronJobRunSummary
+}
+
+// CronJobRunSummary holds whatever counts the job reports about its run, stored as JSON
+type CronJobRunSummary map[string]int64
+
+func (s CronJobRunSummary) Value() (driver.Value, error) {
+	if s == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(s)
+}
+
+func (s *CronJobRunSummary) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return errors.New("cron job run summary is not JSON")
+	}
+
+	return json.Unmarshal(bytes, s)
+}
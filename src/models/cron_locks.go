@@ -0,0 +1,8 @@
+package models
+
+// CronLock is a lease on a cron job's lock.  The fencing token goes up every time the lock is acquired, so writes made
+// with the token of a lease that has since been lost can be refused.
+type CronLock struct {
+	Name         string
+	FencingToken int64
+}
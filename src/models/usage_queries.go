@@ -0,0 +1,65 @@
+package models
+
+import (
+	uuid2 "github.com/google/uuid"
+	"time"
+)
+
+type UsageQueryStatus string
+
+const (
+	// UsageQueryPending is a query which is running
+	UsageQueryPending UsageQueryStatus = "pending"
+	// UsageQueryRetrying is a query which failed, waiting until NextAttemptAt to be started again
+	UsageQueryRetrying  UsageQueryStatus = "retrying"
+	UsageQueryCompleted UsageQueryStatus = "completed"
+	// UsageQueryFailed and UsageQueryCancelled are queries whose final attempt ended that way
+	UsageQueryFailed    UsageQueryStatus = "failed"
+	UsageQueryCancelled UsageQueryStatus = "cancelled"
+)
+
+// UsageQueryExecution is the progress of counting usage through the query backend, which usage report instances and
+// ad-hoc usage queries both go through
+type UsageQueryExecution struct {
+	AthenaQueryId string
+	Status        UsageQueryStatus
+	// Attempts counts the queries started, including the one in AthenaQueryId
+	Attempts      int
+	NextAttemptAt *time.Time
+	CompletedAt   *time.Time
+	FailedAt      *time.Time
+	FailureReason *string
+}
+
+// IsPending is true until the background poller has either ingested the results or given up
+func (e UsageQueryExecution) IsPending() bool {
+	return e.Status == UsageQueryPending || e.Status == UsageQueryRetrying
+}
+
+// IsSameAttempt is true if other has not moved on from this, so is still waiting on the same query
+func (e UsageQueryExecution) IsSameAttempt(other UsageQueryExecution) bool {
+	return e.AthenaQueryId == other.AthenaQueryId && e.Status == other.Status && e.Attempts == other.Attempts
+}
+
+// IsFailed is true once there are no attempts left
+func (e UsageQueryExecution) IsFailed() bool {
+	return e.Status == UsageQueryFailed || e.Status == UsageQueryCancelled
+}
+
+// UsageQuery counts a Subscription's usage between any two times, for when a calendar month's usage report does not
+// cover what is needed
+type UsageQuery struct {
+	Id             uuid2.UUID
+	SubscriptionId uuid2.UUID
+	// StartsAt is inclusive and EndsAt exclusive
+	StartsAt    time.Time
+	EndsAt      time.Time
+	RequestedAt time.Time
+	UsageQueryExecution
+}
+
+type UsageQueryProduct struct {
+	UsageQueryId uuid2.UUID
+	Product      string
+	Value        int
+}
@@ -1,7 +1,10 @@
 package models
 
 import (
+	"database/sql/driver"
+	"errors"
 	uuid2 "github.com/google/uuid"
+	"strings"
 	"time"
 )
 
@@ -16,8 +19,108 @@ type UsageReportInstance struct {
 	Id            uuid2.UUID
 	UsageReportId uuid2.UUID
 	RequestedAt   time.Time
-	AthenaQueryId string
-	CompletedAt   *time.Time
+	// Breakdowns are counted as well as the usage per product
+	Breakdowns UsageReportBreakdowns
+	UsageQueryExecution
+}
+
+// UsageReportBreakdown is a way of counting a usage report's access logs other than per product
+type UsageReportBreakdown string
+
+const (
+	// UsageReportBreakdownDevice counts per Android ID
+	UsageReportBreakdownDevice UsageReportBreakdown = "device"
+	// UsageReportBreakdownEndpoint counts per path and HTTP method
+	UsageReportBreakdownEndpoint UsageReportBreakdown = "endpoint"
+	// UsageReportBreakdownProductDevice counts per product and Android ID
+	UsageReportBreakdownProductDevice UsageReportBreakdown = "product_device"
+)
+
+// UsageReportBreakdowns are stored comma separated, which is also how they are given to the API
+type UsageReportBreakdowns []UsageReportBreakdown
+
+// UsageReportBreakdownsFromString parses comma separated breakdowns, ignoring duplicates and whitespace
+func UsageReportBreakdownsFromString(value string) (UsageReportBreakdowns, error) {
+	breakdowns := UsageReportBreakdowns{}
+	for _, name := range strings.Split(value, ",") {
+		breakdown := UsageReportBreakdown(strings.TrimSpace(name))
+		switch breakdown {
+		case "":
+			continue
+		case UsageReportBreakdownDevice, UsageReportBreakdownEndpoint, UsageReportBreakdownProductDevice:
+			if !breakdowns.Contains(breakdown) {
+				breakdowns = append(breakdowns, breakdown)
+			}
+		default:
+			return nil, errors.New("unknown usage report breakdown: " + string(breakdown))
+		}
+	}
+
+	return breakdowns, nil
+}
+
+func (b UsageReportBreakdowns) Contains(breakdown UsageReportBreakdown) bool {
+	for _, existing := range b {
+		if existing == breakdown {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b UsageReportBreakdowns) String() string {
+	names := make([]string, len(b))
+	for i, breakdown := range b {
+		names[i] = string(breakdown)
+	}
+
+	return strings.Join(names, ",")
+}
+
+func (b UsageReportBreakdowns) Value() (driver.Value, error) {
+	return b.String(), nil
+}
+
+func (b *UsageReportBreakdowns) Scan(value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return errors.New("usage report breakdowns are not text")
+	}
+
+	breakdowns, err := UsageReportBreakdownsFromString(text)
+	if err != nil {
+		return err
+	}
+
+	*b = breakdowns
+	return nil
+}
+
+// UsageReportInstanceBreakdown is the count for one combination of the fields in a breakdown.  Fields which are not
+// part of the breakdown are empty.
+type UsageReportInstanceBreakdown struct {
+	UsageReportInstanceId uuid2.UUID
+	Breakdown             UsageReportBreakdown
+	Product               string
+	AndroidId             string
+	Method                string
+	Path                  string
+	Value                 int
+}
+
+// UsageReportInstanceHour is the count for a product in the hour starting at Hour, which is only stored for hours with
+// usage
+type UsageReportInstanceHour struct {
+	UsageReportInstanceId uuid2.UUID
+	Product               string
+	Hour                  time.Time
+	Value                 int
 }
 
 type UsageReportInstanceProduct struct {
@@ -25,3 +128,16 @@ type UsageReportInstanceProduct struct {
 	Product               string
 	Value                 int
 }
+
+// UsageReportExport is a download of a completed instance's usage.  Aggregate exports are written as soon as they are
+// requested, so have no query.  Raw exports list the records through the query backend, and are written to ObjectKey
+// by the usage report poller once the query completes.
+type UsageReportExport struct {
+	Id                    uuid2.UUID
+	UsageReportInstanceId uuid2.UUID
+	Format                string
+	Level                 string
+	ObjectKey             string
+	RequestedAt           time.Time
+	UsageQueryExecution
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	uuid2 "github.com/google/uuid"
+	"go.uber.org/zap"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"time"
+)
+
+// CreateUsageQuery starts counting the subscription's usage which occurred at or after from and before to.  The usage
+// report poller picks it up from there like a usage report instance.
+func CreateUsageQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) (models.UsageQuery, error) {
+	execution, err := newUsageQueryExecution(func() (string, error) {
+		return UsageQueries.StartQuery(monitoringContext, subscriptionId, from, to, nil)
+	})
+	if err != nil {
+		return models.UsageQuery{}, err
+	}
+
+	usageQuery := models.UsageQuery{
+		Id:                  uuid2.New(),
+		SubscriptionId:      subscriptionId,
+		StartsAt:            from,
+		EndsAt:              to,
+		RequestedAt:         time.Now(),
+		UsageQueryExecution: execution,
+	}
+
+	return usageQuery, db.InsertUsageQuery(monitoringContext, usageQuery)
+}
+
+// PollUsageQuery starts another query for the pending usage query once a retry is due, or checks on its query and
+// ingests the results once it has completed, only locking the usage query to save like PollUsageReportInstance.  It
+// returns true when the usage query is no longer pending.
+func PollUsageQuery(monitoringContext *monitoring.Context, usageQuery models.UsageQuery) (finished bool, err error) {
+	startQuery := func() (string, error) {
+		return UsageQueries.StartQuery(monitoringContext, usageQuery.SubscriptionId, usageQuery.StartsAt, usageQuery.EndsAt, nil)
+	}
+
+	polled := usageQuery
+	results, changed, err := pollUsageQueryExecution(monitoringContext, &polled.UsageQueryExecution, startQuery,
+		zap.String("usageQueryId", usageQuery.Id.String()))
+	if err != nil || !changed {
+		return false, err
+	}
+
+	saved := false
+	err = db.WithTransaction(monitoringContext, func(transaction *db.Transaction) error {
+		locked, current, err := db.LockPendingUsageQuery(monitoringContext, transaction, usageQuery.Id)
+		if err != nil || !locked || !current.IsSameAttempt(usageQuery.UsageQueryExecution) {
+			return err
+		}
+
+		if results != nil {
+			for _, product := range results.Products {
+				err = db.InsertUsageQueryProduct(monitoringContext, transaction, models.UsageQueryProduct{
+					UsageQueryId: usageQuery.Id,
+					Product:      product.Product,
+					Value:        product.Value,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		saved = true
+		return db.UpdateUsageQuery(monitoringContext, transaction, polled)
+	})
+
+	return saved && err == nil && !polled.IsPending(), err
+}
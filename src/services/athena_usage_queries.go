@@ -0,0 +1,509 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/athena"
+	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/cenkalti/backoff/v4"
+	uuid2 "github.com/google/uuid"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"subscriptions/src/aws"
+	"subscriptions/src/config"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/utils"
+	"sync"
+	"time"
+)
+
+// AthenaUsageQueryBackend runs the query in Athena against a single table over every Subscription's access logs, or
+// with Parquet enabled a table over the Parquet copies as well
+type AthenaUsageQueryBackend struct{}
+
+const (
+	jsonTableName = "access_logs"
+	// parquetTableName gives the Parquet table its own name, as a table created before the format was switched would
+	// otherwise be kept by CREATE TABLE IF NOT EXISTS
+	parquetTableName = "access_logs_parquet"
+)
+
+func (b *AthenaUsageQueryBackend) StartQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time, breakdowns models.UsageReportBreakdowns) (string, error) {
+	err := ensureAccessLogTable(monitoringContext)
+	if err != nil {
+		return "", err
+	}
+
+	return createUsageQuery(monitoringContext, subscriptionId, from, to, breakdowns)
+}
+
+func (b *AthenaUsageQueryBackend) GetResults(monitoringContext *monitoring.Context, queryId string) (bool, UsageResults, error) {
+	var results UsageResults
+	completed, _, err := getQueryExecution(monitoringContext, queryId)
+	if err != nil || !completed {
+		return false, results, err
+	}
+
+	paginator := athena.NewGetQueryResultsPaginator(aws.AthenaClient, &athena.GetQueryResultsInput{
+		QueryExecutionId: &queryId,
+	})
+	for firstPage := true; paginator.HasMorePages(); firstPage = false {
+		page, err := paginator.NextPage(monitoringContext)
+		if err != nil {
+			return false, results, err
+		}
+
+		pageResults, err := ParseAthenaResultSet(page.ResultSet, firstPage)
+		if err != nil {
+			return false, results, fmt.Errorf("%w: athena query %s returned invalid results: %s", ErrQueryFailed, queryId, err)
+		}
+
+		results.Products = append(results.Products, pageResults.Products...)
+		results.Series = append(results.Series, pageResults.Series...)
+		results.Breakdowns = append(results.Breakdowns, pageResults.Breakdowns...)
+	}
+
+	return true, results.Combined(), nil
+}
+
+func (b *AthenaUsageQueryBackend) StartRawQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) (string, error) {
+	err := ensureAccessLogTable(monitoringContext)
+	if err != nil {
+		return "", err
+	}
+
+	recordsQuery, err := getRecordsQuery(monitoringContext, subscriptionId, from, to)
+	if err != nil {
+		return "", err
+	}
+
+	rawQuery := fmt.Sprintf(`SELECT %s FROM (%s) ORDER BY occurred_at, id`, strings.Join(RawUsageColumns, ", "), recordsQuery)
+
+	return startQueryExecution(monitoringContext, rawQuery)
+}
+
+// GetRawResults returns the CSV Athena writes the results of every query to, which is in the output bucket the usage
+// export store is over
+func (b *AthenaUsageQueryBackend) GetRawResults(monitoringContext *monitoring.Context, queryId string) (bool, string, error) {
+	completed, execution, err := getQueryExecution(monitoringContext, queryId)
+	if err != nil || !completed {
+		return false, "", err
+	}
+
+	var outputLocation string
+	if execution.ResultConfiguration != nil && execution.ResultConfiguration.OutputLocation != nil {
+		outputLocation = *execution.ResultConfiguration.OutputLocation
+	}
+	if !strings.HasPrefix(outputLocation, getS3OutputLocation()) {
+		return false, "", fmt.Errorf("%w: athena query %s wrote its results to %q, outside of %s", ErrQueryFailed,
+			queryId, outputLocation, getS3OutputLocation())
+	}
+
+	return true, strings.TrimPrefix(outputLocation, getS3OutputLocation()), nil
+}
+
+// getQueryExecution returns true with the execution once the query has succeeded, or an error wrapping ErrQueryFailed
+// or ErrQueryCancelled if it ended another way
+func getQueryExecution(monitoringContext *monitoring.Context, queryId string) (bool, *types.QueryExecution, error) {
+	execution, err := aws.AthenaClient.GetQueryExecution(monitoringContext, &athena.GetQueryExecutionInput{
+		QueryExecutionId: &queryId,
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	status := execution.QueryExecution.Status
+	if status.State == types.QueryExecutionStateFailed || status.State == types.QueryExecutionStateCancelled {
+		reason := string(status.State)
+		if status.StateChangeReason != nil {
+			reason = *status.StateChangeReason
+		}
+
+		if status.State == types.QueryExecutionStateCancelled {
+			return false, nil, fmt.Errorf("%w: athena query %s: %s", ErrQueryCancelled, queryId, reason)
+		}
+
+		return false, nil, fmt.Errorf("%w: athena query %s: %s", ErrQueryFailed, queryId, reason)
+	}
+
+	if status.CompletionDateTime == nil {
+		return false, nil, nil
+	}
+
+	return true, execution.QueryExecution, nil
+}
+
+// usageQueryColumns are the columns createInstanceQuery selects, which Athena returns as the first row of results
+var usageQueryColumns = []string{"grouping", "product", "android_id", "method", "path", "hour", "value"}
+
+// The GROUPING() of the columns for each grouping set.  A bit is set for each column not in the set, with product the
+// most significant.
+const (
+	productGrouping       = 0b01111
+	productHourGrouping   = 0b01110
+	deviceGrouping        = 0b10111
+	endpointGrouping      = 0b11001
+	productDeviceGrouping = 0b00111
+)
+
+var breakdownGroupings = map[int64]models.UsageReportBreakdown{
+	deviceGrouping:        models.UsageReportBreakdownDevice,
+	endpointGrouping:      models.UsageReportBreakdownEndpoint,
+	productDeviceGrouping: models.UsageReportBreakdownProductDevice,
+}
+
+var breakdownGroupingSets = map[models.UsageReportBreakdown]string{
+	models.UsageReportBreakdownDevice:        "(android_id)",
+	models.UsageReportBreakdownEndpoint:      "(method, path)",
+	models.UsageReportBreakdownProductDevice: "(product, android_id)",
+}
+
+// ParseAthenaResultSet reads a page of the results of createInstanceQuery.  Only the first page starts with the header
+// row, which is checked against the columns selected.  Rows which are not a grouping set, its fields and a count are
+// an error, as they mean the query or the table is not what is expected.
+func ParseAthenaResultSet(resultSet *types.ResultSet, firstPage bool) (UsageResults, error) {
+	var results UsageResults
+	if resultSet == nil {
+		return results, errors.New("no result set")
+	}
+
+	rows := resultSet.Rows
+	if firstPage {
+		if len(rows) == 0 {
+			return results, errors.New("no header row")
+		}
+
+		header := make([]string, len(rows[0].Data))
+		for i, datum := range rows[0].Data {
+			if datum.VarCharValue != nil {
+				header[i] = *datum.VarCharValue
+			}
+		}
+		if strings.Join(header, ",") != strings.Join(usageQueryColumns, ",") {
+			return results, fmt.Errorf("expected columns %v but got %v", usageQueryColumns, header)
+		}
+
+		rows = rows[1:]
+	}
+
+	for i, row := range rows {
+		if len(row.Data) != len(usageQueryColumns) {
+			return results, fmt.Errorf("row %d has %d columns, expected %d", i, len(row.Data), len(usageQueryColumns))
+		}
+
+		// Fields outside the row's grouping set are NULL, as are access logs without the field, and both count as empty
+		fields := make([]string, len(row.Data))
+		for j, datum := range row.Data {
+			if datum.VarCharValue != nil {
+				fields[j] = *datum.VarCharValue
+			}
+		}
+
+		grouping, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return results, fmt.Errorf("row %d has grouping %q, expected an integer", i, fields[0])
+		}
+
+		value, err := strconv.ParseInt(fields[6], 10, 32)
+		if err != nil || value < 0 {
+			return results, fmt.Errorf("row %d has count %q, expected a non-negative integer", i, fields[6])
+		}
+
+		if grouping == productGrouping {
+			results.Products = append(results.Products, ProductUsage{Product: fields[1], Value: int(value)})
+			continue
+		}
+
+		if grouping == productHourGrouping {
+			hour, err := strconv.ParseInt(fields[5], 10, 64)
+			if err != nil {
+				return results, fmt.Errorf("row %d has hour %q, expected epoch seconds", i, fields[5])
+			}
+
+			results.Series = append(results.Series, HourlyProductUsage{
+				Product: fields[1],
+				Hour:    time.Unix(hour, 0).UTC(),
+				Value:   int(value),
+			})
+			continue
+		}
+
+		breakdown, known := breakdownGroupings[grouping]
+		if !known {
+			return results, fmt.Errorf("row %d has unknown grouping %d", i, grouping)
+		}
+
+		results.Breakdowns = append(results.Breakdowns, BreakdownUsage{
+			Breakdown: breakdown,
+			Product:   fields[1],
+			AndroidId: fields[2],
+			Method:    fields[3],
+			Path:      fields[4],
+			Value:     int(value),
+		})
+	}
+
+	return results, nil
+}
+
+// accessLogTable records whether this process has created the access log table, so the DDL is issued once rather
+// than for every report requested
+var accessLogTable struct {
+	mutex   sync.Mutex
+	created bool
+}
+
+func ensureAccessLogTable(monitoringContext *monitoring.Context) error {
+	accessLogTable.mutex.Lock()
+	defer accessLogTable.mutex.Unlock()
+
+	if accessLogTable.created {
+		return nil
+	}
+
+	err := setupTable(monitoringContext, jsonTableName, `ROW FORMAT SERDE 'org.openx.data.jsonserde.JsonSerDe'`,
+		getS3InputLocation(""))
+	if err == nil && config.GetConfig().BucketConfig.IsParquetEnabled() {
+		err = setupTable(monitoringContext, parquetTableName, `STORED AS PARQUET`,
+			getS3InputLocation(config.GetConfig().BucketConfig.ParquetPrefix+"/"))
+	}
+	if err != nil {
+		return err
+	}
+
+	accessLogTable.created = true
+	return nil
+}
+
+// setupTable creates a table over every Subscription's access logs under location, partitioned to match the bucket
+// layout of {subscription_id}/{yyyy}/{MM}/{dd}/.  Partition projection works out where each partition is from the
+// query, so no partitions ever need adding.  The day partition includes "month" so the month parts written by the
+// roll-up are read as well.
+func setupTable(monitoringContext *monitoring.Context, tableName string, storage string, location string) error {
+	days := make([]string, 0, 32)
+	for day := 1; day <= 31; day++ {
+		days = append(days, fmt.Sprintf("%02d", day))
+	}
+	days = append(days, "month")
+
+	createTableDDL := fmt.Sprintf(`CREATE EXTERNAL TABLE IF NOT EXISTS %s (
+		id STRING,
+		occurred_at BIGINT,
+		product STRING,
+		method STRING,
+		path STRING,
+		android_id STRING
+	) 
+	PARTITIONED BY (subscription_id STRING, year INT, month STRING, day STRING)
+	%s 
+	LOCATION '%s'
+	TBLPROPERTIES (
+		'projection.enabled' = 'true',
+		'projection.subscription_id.type' = 'injected',
+		'projection.year.type' = 'integer',
+		'projection.year.range' = '2000,2100',
+		'projection.month.type' = 'enum',
+		'projection.month.values' = '01,02,03,04,05,06,07,08,09,10,11,12',
+		'projection.day.type' = 'enum',
+		'projection.day.values' = '%s',
+		'storage.location.template' = '%s${subscription_id}/${year}/${month}/${day}/'
+	)`, tableName, storage, location, strings.Join(days, ","), location)
+
+	ddlResponse, err := aws.AthenaClient.StartQueryExecution(monitoringContext, &athena.StartQueryExecutionInput{
+		QueryString: &createTableDDL,
+		QueryExecutionContext: &types.QueryExecutionContext{
+			Database: &config.GetConfig().AthenaConfig.DatabaseName,
+		},
+		WorkGroup: &config.GetConfig().AthenaConfig.WorkGroupName,
+		ResultConfiguration: &types.ResultConfiguration{
+			OutputLocation: utils.StringPtr(getS3OutputLocation()),
+		},
+	})
+	if err != nil {
+		monitoringContext.Error("Something went wrong issuing create table statement", zap.Error(err))
+		return err
+	}
+
+	err = pollForQueryCompletion(monitoringContext, *ddlResponse.QueryExecutionId)
+	if err != nil {
+		monitoringContext.Error("Something went wrong creating table", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// createUsageQuery counts the usage per product, per product and hour, and each breakdown in one pass over the
+// records with a grouping set each
+func createUsageQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time, breakdowns models.UsageReportBreakdowns) (queryId string, err error) {
+	groupingSets := []string{"(product)", "(product, hour)"}
+	for _, breakdown := range breakdowns {
+		groupingSets = append(groupingSets, breakdownGroupingSets[breakdown])
+	}
+
+	recordsQuery, err := getRecordsQuery(monitoringContext, subscriptionId, from, to)
+	if err != nil {
+		return "", err
+	}
+
+	usageQuery := fmt.Sprintf(`SELECT GROUPING(product, android_id, method, path, hour) AS grouping, 
+		product, android_id, method, path, hour, COUNT(1) AS value 
+		FROM (
+			SELECT product, android_id, method, path, occurred_at - occurred_at %% 3600 AS hour 
+			FROM (%s)
+		) 
+		GROUP BY GROUPING SETS (%s)`,
+		recordsQuery, strings.Join(groupingSets, ", "))
+
+	return startQueryExecution(monitoringContext, usageQuery)
+}
+
+// getRecordsQuery selects the subscription's records which occurred in the range, filtering on the partitions the
+// range touches first so only those are scanned.  With Parquet enabled the Parquet copies only hold the days which
+// have been compacted, so the JSON is read for the rest, such as today.  Records with the same Id are only selected
+// once, records without one are all selected.
+func getRecordsQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) (string, error) {
+	sources := getPartitionsQuery(jsonTableName, subscriptionId, getMonthPartitionFilter(from, to))
+	if config.GetConfig().BucketConfig.IsParquetEnabled() {
+		uncompactedDays, err := getUncompactedDays(monitoringContext, subscriptionId, from, to)
+		if err != nil {
+			return "", err
+		}
+
+		sources = getPartitionsQuery(parquetTableName, subscriptionId, getMonthPartitionFilter(from, to))
+		if len(uncompactedDays) > 0 {
+			sources += " UNION ALL " + getPartitionsQuery(jsonTableName, subscriptionId, getDayPartitionFilter(uncompactedDays))
+		}
+	}
+
+	return fmt.Sprintf(`SELECT %s 
+		FROM (
+			SELECT %s, ROW_NUMBER() OVER (PARTITION BY id) AS copy 
+			FROM (%s) WHERE occurred_at >= %d AND occurred_at < %d
+		) 
+		WHERE id IS NULL OR copy = 1`,
+		strings.Join(RawUsageColumns, ", "), strings.Join(RawUsageColumns, ", "), sources, from.Unix(), to.Unix()), nil
+}
+
+func getPartitionsQuery(tableName string, subscriptionId uuid2.UUID, partitionFilter string) string {
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE subscription_id = '%s' AND (%s)`,
+		strings.Join(RawUsageColumns, ", "), tableName, subscriptionId.String(), partitionFilter)
+}
+
+// getUncompactedDays returns the days the range touches which the compaction ledger does not have as succeeded
+func getUncompactedDays(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) ([]time.Time, error) {
+	firstDay := utils.ToDay(from.UTC())
+	compactionDays, err := db.GetCompactionDays(monitoringContext, subscriptionId, firstDay, to.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	compacted := make(map[string]bool)
+	for _, compactionDay := range compactionDays {
+		if compactionDay.Status == models.CompactionSucceeded {
+			compacted[compactionDay.Day.Format("2006-01-02")] = true
+		}
+	}
+
+	var days []time.Time
+	for day := firstDay; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !compacted[day.Format("2006-01-02")] {
+			days = append(days, day)
+		}
+	}
+
+	return days, nil
+}
+
+func startQueryExecution(monitoringContext *monitoring.Context, query string) (queryId string, err error) {
+	queryResponse, err := aws.AthenaClient.StartQueryExecution(monitoringContext, &athena.StartQueryExecutionInput{
+		QueryString: &query,
+		QueryExecutionContext: &types.QueryExecutionContext{
+			Database: &config.GetConfig().AthenaConfig.DatabaseName,
+		},
+		WorkGroup: &config.GetConfig().AthenaConfig.WorkGroupName,
+		ResultConfiguration: &types.ResultConfiguration{
+			OutputLocation: utils.StringPtr(getS3OutputLocation()),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return *queryResponse.QueryExecutionId, nil
+}
+
+// getMonthPartitionFilter matches the year and month partitions of every month from the one from is in up to the one
+// before to
+func getMonthPartitionFilter(from time.Time, to time.Time) string {
+	var months []string
+	for month := utils.ToMonth(from.UTC()); month.Before(to); month = utils.ToNextMonth(month) {
+		months = append(months, fmt.Sprintf("(year = %d AND month = '%02d')", month.Year(), int(month.Month())))
+	}
+
+	return strings.Join(months, " OR ")
+}
+
+// getDayPartitionFilter matches the year, month and day partitions of every day
+func getDayPartitionFilter(days []time.Time) string {
+	filters := make([]string, len(days))
+	for i, day := range days {
+		filters[i] = fmt.Sprintf("(year = %d AND month = '%02d' AND day = '%02d')", day.Year(), int(day.Month()), day.Day())
+	}
+
+	return strings.Join(filters, " OR ")
+}
+
+func pollForQueryCompletion(monitoringContext *monitoring.Context, id string) error {
+	monitoringContext.Info("Polling for query completion: " + id)
+	failedOrCancelled := false
+	check := func() error {
+		getQueryExecutionOutput, err := aws.AthenaClient.GetQueryExecution(monitoringContext, &athena.GetQueryExecutionInput{
+			QueryExecutionId: &id,
+		})
+		if err != nil {
+			return err
+		}
+
+		state := getQueryExecutionOutput.QueryExecution.Status.State
+
+		if state == types.QueryExecutionStateFailed || state == types.QueryExecutionStateCancelled {
+			failedOrCancelled = true
+			return nil
+		}
+
+		if state == types.QueryExecutionStateSucceeded {
+			return nil
+		}
+
+		return errors.New("query is still queued or running")
+	}
+
+	err := backoff.Retry(check, &backoff.ExponentialBackOff{
+		InitialInterval:     100 * time.Millisecond,
+		RandomizationFactor: 0.5,
+		Multiplier:          1.2,
+		MaxInterval:         1 * time.Second,
+		MaxElapsedTime:      5 * time.Second,
+		Stop:                -1,
+		Clock:               backoff.SystemClock,
+	})
+
+	if failedOrCancelled {
+		return fmt.Errorf("athena query %s was failed or cancelled", id)
+	}
+
+	return err
+}
+
+// getS3InputLocation is where the table reading the objects under prefix in the access log bucket points
+func getS3InputLocation(prefix string) string {
+	return fmt.Sprintf("s3://%s/%s", config.GetConfig().AthenaConfig.InputBucketName, prefix)
+}
+
+func getS3OutputLocation() string {
+	return fmt.Sprintf("s3://%s/", config.GetConfig().AthenaConfig.OutputBucketName)
+}
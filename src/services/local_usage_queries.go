@@ -0,0 +1,313 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	uuid2 "github.com/google/uuid"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+	"subscriptions/src/utils"
+	"time"
+)
+
+const (
+	localQueryIdPrefix    = "local/"
+	localRawResultsPrefix = "usage-query-results/"
+)
+
+// LocalUsageQueryBackend counts the gzipped JSON access logs in the object store in this process.  Nothing runs in
+// the background, the query id just names the subscription and range and the objects are scanned when the results
+// are asked for.  Like the Athena JSON table it reads every line in every object under the months the range touches,
+// whether small object, day object or month part, then counts the records which occurred in the range.  The results
+// of raw queries are written to the usage export store.
+type LocalUsageQueryBackend struct {
+	store   storage.ObjectStore
+	exports storage.ObjectStore
+}
+
+func NewLocalUsageQueryBackend(store storage.ObjectStore, exports storage.ObjectStore) *LocalUsageQueryBackend {
+	return &LocalUsageQueryBackend{store: store, exports: exports}
+}
+
+// localQuery is what the query id of the local backend names
+type localQuery struct {
+	subscriptionId string
+	from           time.Time
+	to             time.Time
+	breakdowns     models.UsageReportBreakdowns
+	// resultsKey is where the results of a raw query are written to
+	resultsKey string
+}
+
+func (b *LocalUsageQueryBackend) StartQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time, breakdowns models.UsageReportBreakdowns) (string, error) {
+	return formatLocalQueryId(localQuery{subscriptionId: subscriptionId.String(), from: from, to: to, breakdowns: breakdowns}), nil
+}
+
+func (b *LocalUsageQueryBackend) StartRawQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) (string, error) {
+	resultsKey := fmt.Sprintf("%s%s.csv", localRawResultsPrefix, uuid2.New())
+	return formatLocalQueryId(localQuery{subscriptionId: subscriptionId.String(), from: from, to: to, resultsKey: resultsKey}), nil
+}
+
+func (b *LocalUsageQueryBackend) GetResults(monitoringContext *monitoring.Context, queryId string) (bool, UsageResults, error) {
+	var results UsageResults
+	query, err := parseLocalQueryId(queryId)
+	if err != nil {
+		return false, results, err
+	}
+
+	counts := make(map[BreakdownUsage]int)
+	hourlyCounts := make(map[HourlyProductUsage]int)
+	err = b.forEachRecordInRange(monitoringContext, query, func(record models.AccessLogRecord) error {
+		counts[BreakdownUsage{Product: record.Product}]++
+		hourlyCounts[HourlyProductUsage{Product: record.Product, Hour: time.Unix(record.OccurredAt-record.OccurredAt%3600, 0).UTC()}]++
+		for _, breakdown := range query.breakdowns {
+			counts[breakdownKey(breakdown, record)]++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, results, err
+	}
+
+	for key, count := range counts {
+		if key.Breakdown == "" {
+			results.Products = append(results.Products, ProductUsage{Product: key.Product, Value: count})
+			continue
+		}
+
+		key.Value = count
+		results.Breakdowns = append(results.Breakdowns, key)
+	}
+	for key, count := range hourlyCounts {
+		key.Value = count
+		results.Series = append(results.Series, key)
+	}
+	sort.Slice(results.Products, func(i, j int) bool {
+		return results.Products[i].Product < results.Products[j].Product
+	})
+	sort.Slice(results.Series, func(i, j int) bool {
+		if !results.Series[i].Hour.Equal(results.Series[j].Hour) {
+			return results.Series[i].Hour.Before(results.Series[j].Hour)
+		}
+
+		return results.Series[i].Product < results.Series[j].Product
+	})
+	sort.Slice(results.Breakdowns, func(i, j int) bool {
+		a, b := results.Breakdowns[i], results.Breakdowns[j]
+		if a.Breakdown != b.Breakdown {
+			return a.Breakdown < b.Breakdown
+		}
+		if a.Product != b.Product {
+			return a.Product < b.Product
+		}
+		if a.AndroidId != b.AndroidId {
+			return a.AndroidId < b.AndroidId
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+
+		return a.Method < b.Method
+	})
+
+	return true, results, nil
+}
+
+// GetRawResults writes the records to the usage export store as CSV, streaming them so a busy month is never held in
+// memory
+func (b *LocalUsageQueryBackend) GetRawResults(monitoringContext *monitoring.Context, queryId string) (bool, string, error) {
+	query, err := parseLocalQueryId(queryId)
+	if err != nil {
+		return false, "", err
+	}
+	if query.resultsKey == "" {
+		return false, "", fmt.Errorf("%w: query %s is not a raw query", ErrQueryFailed, queryId)
+	}
+
+	err = putStreamed(monitoringContext, b.exports, query.resultsKey, func(writer io.Writer) error {
+		csvWriter := csv.NewWriter(writer)
+		if err := csvWriter.Write(RawUsageColumns); err != nil {
+			return err
+		}
+
+		err := b.forEachRecordInRange(monitoringContext, query, func(record models.AccessLogRecord) error {
+			// Athena has NULL for a record without an Id, which it writes to CSV as empty
+			id := ""
+			if record.Id != uuid2.Nil {
+				id = record.Id.String()
+			}
+
+			return csvWriter.Write([]string{id, strconv.FormatInt(record.OccurredAt, 10), record.Product,
+				record.Method, record.Path, record.AndroidId})
+		})
+		if err != nil {
+			return err
+		}
+
+		csvWriter.Flush()
+		return csvWriter.Error()
+	})
+	if err != nil {
+		return false, "", err
+	}
+
+	return true, query.resultsKey, nil
+}
+
+// forEachRecordInRange calls action with each of the subscription's records which occurred in the range, skipping
+// records with an Id already seen
+func (b *LocalUsageQueryBackend) forEachRecordInRange(monitoringContext *monitoring.Context, query localQuery, action func(record models.AccessLogRecord) error) error {
+	var keys []string
+	for month := utils.ToMonth(query.from); month.Before(query.to); month = utils.ToNextMonth(month) {
+		err := storage.ForEachObject(monitoringContext, b.store, getMonthPrefix(query.subscriptionId, month)+"/", func(object storage.ObjectInfo) {
+			keys = append(keys, object.Key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	seenIds := make(map[uuid2.UUID]struct{})
+	for _, key := range keys {
+		var actionErr error
+		err := forEachAccessLogRecord(monitoringContext, b.store, key, func(record models.AccessLogRecord) {
+			if actionErr != nil || record.OccurredAt < query.from.Unix() || record.OccurredAt >= query.to.Unix() {
+				return
+			}
+
+			if record.Id != uuid2.Nil {
+				if _, seen := seenIds[record.Id]; seen {
+					return
+				}
+				seenIds[record.Id] = struct{}{}
+			}
+
+			actionErr = action(record)
+		})
+		if err != nil {
+			return err
+		}
+		if actionErr != nil {
+			return actionErr
+		}
+	}
+
+	return nil
+}
+
+// breakdownKey keeps only the fields of the record which are part of the breakdown, so records are counted together
+// when those fields match
+func breakdownKey(breakdown models.UsageReportBreakdown, record models.AccessLogRecord) BreakdownUsage {
+	key := BreakdownUsage{Breakdown: breakdown}
+	switch breakdown {
+	case models.UsageReportBreakdownDevice:
+		key.AndroidId = record.AndroidId
+	case models.UsageReportBreakdownEndpoint:
+		key.Method = record.Method
+		key.Path = record.Path
+	case models.UsageReportBreakdownProductDevice:
+		key.Product = record.Product
+		key.AndroidId = record.AndroidId
+	}
+
+	return key
+}
+
+// forEachAccessLogRecord calls action with each record in the gzipped JSON object.  Lines which are not access log
+// records are skipped, as Athena would skip them.  An object which is not valid gzip fails the query, as it would in
+// Athena, since reading it again would fail the same way.
+func forEachAccessLogRecord(monitoringContext *monitoring.Context, store storage.ObjectStore, key string, action func(record models.AccessLogRecord)) error {
+	body, err := store.Get(monitoringContext, key)
+	if err != nil {
+		return fmt.Errorf("could not get object %s: %w", key, err)
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("%w: could not create gzip reader for object %s: %s", ErrQueryFailed, key, err)
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("%w: could not un-gzip object %s: %s", ErrQueryFailed, key, readErr)
+		}
+
+		var record models.AccessLogRecord
+		if len(strings.TrimSpace(string(line))) > 0 && json.Unmarshal(line, &record) == nil {
+			action(record)
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+func formatLocalQueryId(query localQuery) string {
+	values := url.Values{}
+	values.Set("from", strconv.FormatInt(query.from.Unix(), 10))
+	values.Set("to", strconv.FormatInt(query.to.Unix(), 10))
+	if len(query.breakdowns) > 0 {
+		values.Set("breakdowns", query.breakdowns.String())
+	}
+	if query.resultsKey != "" {
+		values.Set("results", query.resultsKey)
+	}
+
+	return localQueryIdPrefix + query.subscriptionId + "?" + values.Encode()
+}
+
+// parseLocalQueryId reads back what formatLocalQueryId put in the query id.  An id which cannot be read will never
+// have results, so the error wraps ErrQueryFailed.
+func parseLocalQueryId(queryId string) (localQuery, error) {
+	var query localQuery
+	if !strings.HasPrefix(queryId, localQueryIdPrefix) {
+		return query, fmt.Errorf("%w: query %s was not started by the local usage query backend", ErrQueryFailed, queryId)
+	}
+
+	subscriptionId, rawQuery, _ := strings.Cut(strings.TrimPrefix(queryId, localQueryIdPrefix), "?")
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return query, fmt.Errorf("%w: %s", ErrQueryFailed, err)
+	}
+
+	fromSeconds, err := strconv.ParseInt(values.Get("from"), 10, 64)
+	if err != nil {
+		return query, fmt.Errorf("%w: invalid from in query id: %s", ErrQueryFailed, err)
+	}
+	toSeconds, err := strconv.ParseInt(values.Get("to"), 10, 64)
+	if err != nil {
+		return query, fmt.Errorf("%w: invalid to in query id: %s", ErrQueryFailed, err)
+	}
+
+	breakdowns, err := models.UsageReportBreakdownsFromString(values.Get("breakdowns"))
+	if err != nil {
+		return query, fmt.Errorf("%w: %s", ErrQueryFailed, err)
+	}
+
+	return localQuery{
+		subscriptionId: subscriptionId,
+		from:           time.Unix(fromSeconds, 0).UTC(),
+		to:             time.Unix(toSeconds, 0).UTC(),
+		breakdowns:     breakdowns,
+		resultsKey:     values.Get("results"),
+	}, nil
+}
+
+func getMonthPrefix(subscriptionId string, month time.Time) string {
+	return fmt.Sprintf("%s/%s", subscriptionId, month.Format("2006/01"))
+}
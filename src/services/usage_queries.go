@@ -0,0 +1,132 @@
+package services
+
+import (
+	"errors"
+	uuid2 "github.com/google/uuid"
+	"subscriptions/src/config"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+	"time"
+)
+
+// ProductUsage is the number of access log records for a product in the range queried
+type ProductUsage struct {
+	Product string
+	Value   int
+}
+
+// BreakdownUsage is the number of access log records for one combination of a breakdown's fields.  Fields which are
+// not part of the breakdown are empty.
+type BreakdownUsage struct {
+	Breakdown models.UsageReportBreakdown
+	Product   string
+	AndroidId string
+	Method    string
+	Path      string
+	Value     int
+}
+
+// HourlyProductUsage is the number of access log records for a product which occurred in the hour starting at Hour
+type HourlyProductUsage struct {
+	Product string
+	Hour    time.Time
+	Value   int
+}
+
+// UsageResults are the usage per product and per product each hour, which are always counted, and for each breakdown
+// asked for.  Hours without usage are left out of the series.
+type UsageResults struct {
+	Products   []ProductUsage
+	Series     []HourlyProductUsage
+	Breakdowns []BreakdownUsage
+}
+
+// Combined adds together the usage counted more than once for the same product, hour or combination of a breakdown's
+// fields, keeping the order each was first seen in.  Athena groups records whose field is NULL apart from those whose
+// field is empty, but both are read as empty, so would otherwise be stored twice.
+func (r UsageResults) Combined() UsageResults {
+	var combined UsageResults
+
+	products := make(map[string]int)
+	for _, product := range r.Products {
+		if i, seen := products[product.Product]; seen {
+			combined.Products[i].Value += product.Value
+			continue
+		}
+
+		products[product.Product] = len(combined.Products)
+		combined.Products = append(combined.Products, product)
+	}
+
+	hours := make(map[HourlyProductUsage]int)
+	for _, hour := range r.Series {
+		key := HourlyProductUsage{Product: hour.Product, Hour: hour.Hour}
+		if i, seen := hours[key]; seen {
+			combined.Series[i].Value += hour.Value
+			continue
+		}
+
+		hours[key] = len(combined.Series)
+		combined.Series = append(combined.Series, hour)
+	}
+
+	breakdowns := make(map[BreakdownUsage]int)
+	for _, breakdown := range r.Breakdowns {
+		key := breakdown
+		key.Value = 0
+		if i, seen := breakdowns[key]; seen {
+			combined.Breakdowns[i].Value += breakdown.Value
+			continue
+		}
+
+		breakdowns[key] = len(combined.Breakdowns)
+		combined.Breakdowns = append(combined.Breakdowns, breakdown)
+	}
+
+	return combined
+}
+
+// ErrQueryFailed and ErrQueryCancelled are returned by GetResults when the query has ended without results and will
+// not produce any
+var (
+	ErrQueryFailed    = errors.New("usage query failed")
+	ErrQueryCancelled = errors.New("usage query cancelled")
+)
+
+// RawUsageColumns are the header of the CSV the results of a raw query are written as
+var RawUsageColumns = []string{"id", "occurred_at", "product", "method", "path", "android_id"}
+
+// UsageQueryBackend counts a subscription's access logs which occurred in a range by product and any breakdowns, or
+// lists them.  Queries are started when a report instance, usage query or raw export is requested and checked on by
+// the usage report poller, so a backend may answer straight away or later.  A record written more than once with the
+// same Id, such as by an ingestion retry, is only counted or listed once.
+type UsageQueryBackend interface {
+	// StartQuery returns an id which GetResults can be called with until the query has completed.  Records are counted
+	// when they occurred at or after from and before to.
+	StartQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time, breakdowns models.UsageReportBreakdowns) (queryId string, err error)
+	// GetResults returns false while the query is still running, then the usage for each product and breakdown.  An
+	// error wrapping ErrQueryFailed or ErrQueryCancelled means the query will never complete, any other error may be
+	// temporary.
+	GetResults(monitoringContext *monitoring.Context, queryId string) (completed bool, results UsageResults, err error)
+	// StartRawQuery returns an id which GetRawResults can be called with until the query has completed.  Records are
+	// listed when they occurred at or after from and before to.
+	StartRawQuery(monitoringContext *monitoring.Context, subscriptionId uuid2.UUID, from time.Time, to time.Time) (queryId string, err error)
+	// GetRawResults returns false while the query is still running, then the key in the usage export store of a CSV of
+	// the records with a header of RawUsageColumns.  Errors are the same as GetResults.
+	GetRawResults(monitoringContext *monitoring.Context, queryId string) (completed bool, key string, err error)
+}
+
+// UsageQueries is the backend selected by the profile, set up by SetupUsageQueries
+var UsageQueries UsageQueryBackend
+
+// SetupUsageQueries selects the backend in the profile.  The local backend reads from and writes to the object stores
+// so needs SetupStorage to have been called.
+func SetupUsageQueries() {
+	switch config.GetConfig().UsageQueryConfig.Backend {
+	case config.UsageQueryBackendLocal:
+		UsageQueries = NewLocalUsageQueryBackend(storage.AccessLogs, storage.UsageExports)
+	default:
+		UsageQueries = &AthenaUsageQueryBackend{}
+	}
+}
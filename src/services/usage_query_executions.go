@@ -0,0 +1,121 @@
+package services
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"subscriptions/src/config"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/utils"
+	"time"
+)
+
+const (
+	defaultMaxAttempts  = 3
+	defaultRetryBackoff = time.Minute
+)
+
+// newUsageQueryExecution starts the first attempt of a query
+func newUsageQueryExecution(startQuery func() (string, error)) (models.UsageQueryExecution, error) {
+	queryId, err := startQuery()
+	if err != nil {
+		return models.UsageQueryExecution{}, err
+	}
+
+	return models.UsageQueryExecution{
+		AthenaQueryId: queryId,
+		Status:        models.UsageQueryPending,
+		Attempts:      1,
+	}, nil
+}
+
+// pollUsageQueryExecution moves a pending execution on: it starts another query with startQuery once a retry is due,
+// or checks on the running query.  A query which fails is retried with backoff until the attempts in the profile run
+// out, when the execution is marked failed.  The results are returned once the query has completed.  When changed is
+// true the execution has been updated and needs saving along with any results.
+func pollUsageQueryExecution(monitoringContext *monitoring.Context, execution *models.UsageQueryExecution, startQuery func() (string, error), logFields ...zap.Field) (results *UsageResults, changed bool, err error) {
+	var queryResults UsageResults
+	completed, changed, err := pollExecution(monitoringContext, execution, startQuery, func(queryId string) (bool, error) {
+		completed, usage, err := UsageQueries.GetResults(monitoringContext, queryId)
+		queryResults = usage
+		return completed, err
+	}, logFields...)
+	if !completed {
+		return nil, changed, err
+	}
+
+	return &queryResults, changed, err
+}
+
+// pollExecution is pollUsageQueryExecution for any kind of query, which checkQuery checks on.  checkQuery returns
+// true once the query has completed and its results have been used, or an error like UsageQueryBackend.GetResults.
+func pollExecution(monitoringContext *monitoring.Context, execution *models.UsageQueryExecution, startQuery func() (string, error), checkQuery func(queryId string) (bool, error), logFields ...zap.Field) (completed bool, changed bool, err error) {
+	if execution.Status == models.UsageQueryRetrying {
+		execution.Attempts++
+		monitoringContext.Info("Retrying usage query", append(logFields, zap.Int("attempt", execution.Attempts))...)
+
+		queryId, err := startQuery()
+		if err != nil {
+			recordFailedAttempt(monitoringContext, execution, err, logFields...)
+			return false, true, nil
+		}
+
+		execution.AthenaQueryId = queryId
+		execution.Status = models.UsageQueryPending
+		execution.NextAttemptAt = nil
+		return false, true, nil
+	}
+
+	completed, err = checkQuery(execution.AthenaQueryId)
+	if errors.Is(err, ErrQueryFailed) || errors.Is(err, ErrQueryCancelled) {
+		recordFailedAttempt(monitoringContext, execution, err, logFields...)
+		return false, true, nil
+	}
+	if err != nil || !completed {
+		return false, false, err
+	}
+
+	execution.Status = models.UsageQueryCompleted
+	execution.CompletedAt = utils.TimePtr(time.Now())
+	return true, true, nil
+}
+
+// recordFailedAttempt schedules the next attempt, or marks the execution failed or cancelled depending on how its
+// final query ended
+func recordFailedAttempt(monitoringContext *monitoring.Context, execution *models.UsageQueryExecution, cause error, logFields ...zap.Field) {
+	monitoringContext.Error("Usage query failed", append(logFields, zap.Error(cause), zap.Int("attempt", execution.Attempts))...)
+
+	execution.FailureReason = utils.StringPtr(cause.Error())
+
+	if execution.Attempts >= getMaxAttempts() {
+		execution.Status = models.UsageQueryFailed
+		if errors.Is(cause, ErrQueryCancelled) {
+			execution.Status = models.UsageQueryCancelled
+		}
+		execution.NextAttemptAt = nil
+		execution.FailedAt = utils.TimePtr(time.Now())
+		return
+	}
+
+	backoff := getRetryBackoff() << (execution.Attempts - 1)
+	execution.Status = models.UsageQueryRetrying
+	execution.NextAttemptAt = utils.TimePtr(time.Now().Add(backoff))
+}
+
+func getMaxAttempts() int {
+	maxAttempts := config.GetConfig().UsageQueryConfig.MaxAttempts
+	if maxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+
+	return maxAttempts
+}
+
+func getRetryBackoff() time.Duration {
+	backoff := time.Duration(config.GetConfig().UsageQueryConfig.RetryBackoffSeconds) * time.Second
+	if backoff <= 0 {
+		return defaultRetryBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	uuid2 "github.com/google/uuid"
+	"go.uber.org/zap"
+	"io"
+	"strconv"
+	"strings"
+	"subscriptions/src/config"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+	"subscriptions/src/utils"
+	"time"
+)
+
+const (
+	UsageExportFormatCsv   = "csv"
+	UsageExportFormatJsonl = "jsonl"
+)
+
+const (
+	// UsageExportLevelAggregate is the counts the report instance ingested: per product, per product and hour, and
+	// per combination of each breakdown's fields
+	UsageExportLevelAggregate = "aggregate"
+	// UsageExportLevelRaw is every access log record which occurred in the report's month, once for each Id
+	UsageExportLevelRaw = "raw"
+)
+
+const defaultExportUrlExpiry = 15 * time.Minute
+
+// UsageExport is where an export can be downloaded from until it expires
+type UsageExport struct {
+	Url       string
+	ExpiresAt time.Time
+}
+
+var aggregateExportColumns = []string{"kind", "product", "android_id", "method", "path", "hour", "value"}
+
+// ExportUsageReportInstance exports the completed instance's usage in the format and at the level asked for.  An
+// aggregate export is written from the counts already stored for the instance before returning.  A raw export lists
+// the records of the report's month through the query backend, so is written by the usage report poller once that
+// query completes, and is pending until then.
+func ExportUsageReportInstance(monitoringContext *monitoring.Context, usageReport models.UsageReport, instance models.UsageReportInstance, format string, level string) (models.UsageReportExport, error) {
+	export := models.UsageReportExport{
+		Id:                    uuid2.New(),
+		UsageReportInstanceId: instance.Id,
+		Format:                format,
+		Level:                 level,
+		RequestedAt:           time.Now(),
+	}
+	export.ObjectKey = fmt.Sprintf("usage-report-exports/%s/%s/%s.%s", usageReport.SubscriptionId, instance.Id, export.Id, format)
+
+	if level == UsageExportLevelRaw {
+		execution, err := newUsageQueryExecution(func() (string, error) {
+			return startRawExportQuery(monitoringContext, usageReport)
+		})
+		if err != nil {
+			return export, err
+		}
+
+		export.UsageQueryExecution = execution
+		return export, db.InsertUsageReportExport(monitoringContext, export)
+	}
+
+	err := putStreamed(monitoringContext, storage.UsageExports, export.ObjectKey, func(writer io.Writer) error {
+		rows, err := newExportRowWriter(writer, format, aggregateExportColumns)
+		if err != nil {
+			return err
+		}
+
+		err = writeAggregateExportRows(monitoringContext, rows, instance)
+		if err != nil {
+			return err
+		}
+
+		return rows.Flush()
+	})
+	if err != nil {
+		return export, err
+	}
+
+	export.Status = models.UsageQueryCompleted
+	export.Attempts = 1
+	export.CompletedAt = utils.TimePtr(time.Now())
+	return export, db.InsertUsageReportExport(monitoringContext, export)
+}
+
+// startRawExportQuery lists the records in the report's calendar month
+func startRawExportQuery(monitoringContext *monitoring.Context, usageReport models.UsageReport) (string, error) {
+	month := utils.GetMonth(usageReport.Year, usageReport.Month)
+	return UsageQueries.StartRawQuery(monitoringContext, usageReport.SubscriptionId, month, utils.ToNextMonth(month))
+}
+
+// PresignUsageReportExport returns a URL the completed export can be downloaded from until it expires
+func PresignUsageReportExport(monitoringContext *monitoring.Context, export models.UsageReportExport) (UsageExport, error) {
+	expiry := getExportUrlExpiry()
+	url, err := storage.UsageExports.Presign(monitoringContext, export.ObjectKey, expiry)
+	if err != nil {
+		return UsageExport{}, err
+	}
+
+	return UsageExport{Url: url, ExpiresAt: time.Now().Add(expiry)}, nil
+}
+
+// PollUsageReportExport starts another query for the pending export once a retry is due, or checks on its query and
+// writes the raw export once it has completed, only locking the export to save like PollUsageReportInstance.  It
+// returns true when the export is no longer pending.
+func PollUsageReportExport(monitoringContext *monitoring.Context, export models.UsageReportExport) (finished bool, err error) {
+	startQuery := func() (string, error) {
+		exists, usageReport, err := db.GetUsageReportForInstance(monitoringContext, export.UsageReportInstanceId)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("usage report for instance %s does not exist", export.UsageReportInstanceId)
+		}
+
+		return startRawExportQuery(monitoringContext, usageReport)
+	}
+
+	checkQuery := func(queryId string) (bool, error) {
+		completed, resultsKey, err := UsageQueries.GetRawResults(monitoringContext, queryId)
+		if err != nil || !completed {
+			return false, err
+		}
+
+		return true, writeRawExport(monitoringContext, export, resultsKey)
+	}
+
+	polled := export
+	_, changed, err := pollExecution(monitoringContext, &polled.UsageQueryExecution, startQuery, checkQuery,
+		zap.String("usageReportExportId", export.Id.String()))
+	if err != nil || !changed {
+		return false, err
+	}
+
+	saved := false
+	err = db.WithTransaction(monitoringContext, func(transaction *db.Transaction) error {
+		locked, current, err := db.LockPendingUsageReportExport(monitoringContext, transaction, export.Id)
+		if err != nil || !locked || !current.IsSameAttempt(export.UsageQueryExecution) {
+			return err
+		}
+
+		saved = true
+		return db.UpdateUsageReportExport(monitoringContext, transaction, polled)
+	})
+
+	return saved && err == nil && !polled.IsPending(), err
+}
+
+// writeRawExport streams the CSV results of the raw query into the export, in the format asked for.  Fields Athena had
+// as NULL are empty in the results, and are null in JSON Lines the same as in aggregate exports.  Results which are not
+// the columns asked for will not get any better by reading them again, so fail the query.
+func writeRawExport(monitoringContext *monitoring.Context, export models.UsageReportExport, resultsKey string) error {
+	results, err := storage.UsageExports.Get(monitoringContext, resultsKey)
+	if err != nil {
+		return fmt.Errorf("could not get raw query results %s: %w", resultsKey, err)
+	}
+	defer results.Close()
+
+	return putStreamed(monitoringContext, storage.UsageExports, export.ObjectKey, func(writer io.Writer) error {
+		rows, err := newExportRowWriter(writer, export.Format, RawUsageColumns)
+		if err != nil {
+			return err
+		}
+
+		reader := csv.NewReader(results)
+		header, err := reader.Read()
+		if err != nil || strings.Join(header, ",") != strings.Join(RawUsageColumns, ",") {
+			return fmt.Errorf("%w: raw query results %s do not start with a header of %v", ErrQueryFailed, resultsKey, RawUsageColumns)
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%w: could not read raw query results %s: %s", ErrQueryFailed, resultsKey, err)
+			}
+
+			occurredAt, err := strconv.ParseInt(record[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: raw query results %s have occurred_at %q, expected epoch seconds",
+					ErrQueryFailed, resultsKey, record[1])
+			}
+
+			err = rows.Write([]interface{}{emptyToNil(record[0]), occurredAt, emptyToNil(record[2]), emptyToNil(record[3]),
+				emptyToNil(record[4]), emptyToNil(record[5])})
+			if err != nil {
+				return err
+			}
+		}
+
+		return rows.Flush()
+	})
+}
+
+// putStreamed uploads what write writes to key as it is written, so the whole object is never held in memory
+func putStreamed(monitoringContext *monitoring.Context, store storage.ObjectStore, key string, write func(writer io.Writer) error) error {
+	pipeReader, pipeWriter := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := store.PutMultipart(monitoringContext, key, pipeReader)
+
+		// Unblocks the writer if the upload gave up part way through
+		pipeReader.CloseWithError(err)
+		result <- err
+	}()
+
+	err := write(pipeWriter)
+	if err != nil {
+		pipeWriter.CloseWithError(err)
+		<-result
+		return err
+	}
+
+	pipeWriter.Close()
+	return <-result
+}
+
+// writeAggregateExportRows writes a row for each count stored for the instance.  kind is product for the usage per
+// product, hour for the usage per product and hour, or the name of the breakdown, and only the columns the count is
+// for are set.
+func writeAggregateExportRows(monitoringContext *monitoring.Context, rows exportRowWriter, instance models.UsageReportInstance) error {
+	products, err := db.GetUsageReportInstanceProducts(monitoringContext, instance.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		err = rows.Write([]interface{}{"product", product.Product, nil, nil, nil, nil, product.Value})
+		if err != nil {
+			return err
+		}
+	}
+
+	hours, err := db.GetUsageReportInstanceHours(monitoringContext, instance.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, hour := range hours {
+		err = rows.Write([]interface{}{"hour", hour.Product, nil, nil, nil, hour.Hour.Unix(), hour.Value})
+		if err != nil {
+			return err
+		}
+	}
+
+	breakdowns, err := db.GetUsageReportInstanceBreakdowns(monitoringContext, instance.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, breakdown := range breakdowns {
+		err = rows.Write([]interface{}{string(breakdown.Breakdown), emptyToNil(breakdown.Product),
+			emptyToNil(breakdown.AndroidId), emptyToNil(breakdown.Method), emptyToNil(breakdown.Path), nil, breakdown.Value})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func emptyToNil(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+
+	return value
+}
+
+// exportRowWriter writes rows whose values line up with the columns it was created with.  nil values are empty in
+// CSV and null in JSON Lines.
+type exportRowWriter interface {
+	Write(values []interface{}) error
+	Flush() error
+}
+
+func newExportRowWriter(writer io.Writer, format string, columns []string) (exportRowWriter, error) {
+	switch format {
+	case UsageExportFormatCsv:
+		csvWriter := csv.NewWriter(writer)
+		err := csvWriter.Write(columns)
+		if err != nil {
+			return nil, err
+		}
+
+		return &csvRowWriter{writer: csvWriter, record: make([]string, len(columns))}, nil
+	case UsageExportFormatJsonl:
+		return &jsonlRowWriter{encoder: json.NewEncoder(writer), columns: columns}, nil
+	default:
+		return nil, fmt.Errorf("unknown usage export format %s", format)
+	}
+}
+
+type csvRowWriter struct {
+	writer *csv.Writer
+	record []string
+}
+
+func (w *csvRowWriter) Write(values []interface{}) error {
+	for i, value := range values {
+		switch typed := value.(type) {
+		case nil:
+			w.record[i] = ""
+		case string:
+			w.record[i] = typed
+		case int:
+			w.record[i] = strconv.Itoa(typed)
+		case int64:
+			w.record[i] = strconv.FormatInt(typed, 10)
+		default:
+			w.record[i] = fmt.Sprint(typed)
+		}
+	}
+
+	return w.writer.Write(w.record)
+}
+
+func (w *csvRowWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type jsonlRowWriter struct {
+	encoder *json.Encoder
+	columns []string
+}
+
+func (w *jsonlRowWriter) Write(values []interface{}) error {
+	row := make(map[string]interface{}, len(w.columns))
+	for i, column := range w.columns {
+		row[column] = values[i]
+	}
+
+	return w.encoder.Encode(row)
+}
+
+func (w *jsonlRowWriter) Flush() error {
+	return nil
+}
+
+func getExportUrlExpiry() time.Duration {
+	expiry := time.Duration(config.GetConfig().UsageQueryConfig.ExportUrlExpirySeconds) * time.Second
+	if expiry <= 0 {
+		return defaultExportUrlExpiry
+	}
+
+	return expiry
+}
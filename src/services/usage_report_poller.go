@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"subscriptions/src/config"
+	db "subscriptions/src/database"
+	"subscriptions/src/monitoring"
+	"sync"
+	"time"
+)
+
+// pollBatchSize caps how many pending usage report instances, usage queries and raw exports are each checked on every
+// tick, so a backlog is worked through over several ticks rather than holding up shutdown
+const pollBatchSize = 100
+
+const defaultPollInterval = 10 * time.Second
+
+type usageReportPoller struct {
+	interval time.Duration
+	// monitoringContext is what polls run with, cancelled if one is still going at the shutdown deadline
+	monitoringContext *monitoring.Context
+	cancel            context.CancelFunc
+	stop              chan struct{}
+	done              sync.WaitGroup
+}
+
+var poller *usageReportPoller
+
+// StartUsageReportPoller checks on the queries of pending usage report instances, usage queries and raw exports every
+// poll interval, so they complete whether or not anyone is reading them and reading one never waits on the query
+// backend.
+func StartUsageReportPoller() {
+	interval := time.Duration(config.GetConfig().UsageQueryConfig.PollIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	poller = &usageReportPoller{
+		interval:          interval,
+		monitoringContext: monitoring.NewMonitoringContext(monitoring.GlobalContext.Logger, ctx),
+		cancel:            cancel,
+		stop:              make(chan struct{}),
+	}
+
+	poller.done.Add(1)
+	go poller.pollUntilStopped()
+
+	monitoring.GlobalContext.Info("Started usage report poller", zap.Duration("interval", interval))
+}
+
+// StopUsageReportPoller waits for the poll in progress to finish, cancelling it if ctx is done first.  Anything it did
+// not get to are picked up by the next pod to start.
+func StopUsageReportPoller(ctx context.Context) {
+	if poller == nil {
+		return
+	}
+
+	close(poller.stop)
+	defer poller.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		poller.done.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		monitoring.GlobalContext.Info("Stopped usage report poller")
+	case <-ctx.Done():
+		monitoring.GlobalContext.Error("Usage report poll did not finish before shutdown deadline, cancelling it")
+	}
+}
+
+func (p *usageReportPoller) pollUntilStopped() {
+	defer p.done.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.poll()
+		}
+	}
+}
+
+func (p *usageReportPoller) poll() {
+	if !db.IsInitialized() {
+		return
+	}
+
+	p.pollUsageReportInstances()
+	p.pollUsageQueries()
+	p.pollUsageReportExports()
+}
+
+func (p *usageReportPoller) stopping() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *usageReportPoller) pollUsageReportInstances() {
+	instances, err := db.GetPendingUsageReportInstances(p.monitoringContext, pollBatchSize)
+	if err != nil {
+		monitoring.GlobalContext.Error("Could not get pending usage report instances", zap.Error(err))
+		return
+	}
+
+	for _, instance := range instances {
+		if p.stopping() {
+			return
+		}
+
+		finished, err := PollUsageReportInstance(p.monitoringContext, instance)
+		if err != nil {
+			monitoring.GlobalContext.Error("Could not check on usage report instance", zap.Error(err),
+				zap.String("usageReportInstanceId", instance.Id.String()))
+			continue
+		}
+
+		if finished {
+			monitoring.GlobalContext.Info("Usage report instance finished",
+				zap.String("usageReportInstanceId", instance.Id.String()))
+		}
+	}
+}
+
+func (p *usageReportPoller) pollUsageQueries() {
+	usageQueries, err := db.GetPendingUsageQueries(p.monitoringContext, pollBatchSize)
+	if err != nil {
+		monitoring.GlobalContext.Error("Could not get pending usage queries", zap.Error(err))
+		return
+	}
+
+	for _, usageQuery := range usageQueries {
+		if p.stopping() {
+			return
+		}
+
+		finished, err := PollUsageQuery(p.monitoringContext, usageQuery)
+		if err != nil {
+			monitoring.GlobalContext.Error("Could not check on usage query", zap.Error(err),
+				zap.String("usageQueryId", usageQuery.Id.String()))
+			continue
+		}
+
+		if finished {
+			monitoring.GlobalContext.Info("Usage query finished", zap.String("usageQueryId", usageQuery.Id.String()))
+		}
+	}
+}
+
+func (p *usageReportPoller) pollUsageReportExports() {
+	exports, err := db.GetPendingUsageReportExports(p.monitoringContext, pollBatchSize)
+	if err != nil {
+		monitoring.GlobalContext.Error("Could not get pending usage report exports", zap.Error(err))
+		return
+	}
+
+	for _, export := range exports {
+		if p.stopping() {
+			return
+		}
+
+		finished, err := PollUsageReportExport(p.monitoringContext, export)
+		if err != nil {
+			monitoring.GlobalContext.Error("Could not check on usage report export", zap.Error(err),
+				zap.String("usageReportExportId", export.Id.String()))
+			continue
+		}
+
+		if finished {
+			monitoring.GlobalContext.Info("Usage report export finished",
+				zap.String("usageReportExportId", export.Id.String()))
+		}
+	}
+}
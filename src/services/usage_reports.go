@@ -1,16 +1,9 @@
 package services
 
 import (
-	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/service/athena"
-	"github.com/aws/aws-sdk-go-v2/service/athena/types"
-	"github.com/cenkalti/backoff/v4"
 	uuid2 "github.com/google/uuid"
 	"go.uber.org/zap"
-	"strings"
-	"subscriptions/src/aws"
-	"subscriptions/src/config"
 	db "subscriptions/src/database"
 	"subscriptions/src/models"
 	"subscriptions/src/monitoring"
@@ -23,29 +16,27 @@ type missingMonth struct {
 	month int
 }
 
-func CreateReportInstance(monitoringContext *monitoring.Context, usageReport models.UsageReport) error {
-	err := setupTable(monitoringContext, usageReport)
-	if err != nil {
-		return err
-	}
-
-	reportInstance := models.UsageReportInstance{
-		Id:            uuid2.New(),
-		UsageReportId: usageReport.Id,
-		RequestedAt:   time.Now(),
-		AthenaQueryId: "",
-		CompletedAt:   nil,
-	}
-
-	queryId, err := createInstanceQuery(monitoringContext, usageReport)
+func CreateReportInstance(monitoringContext *monitoring.Context, usageReport models.UsageReport, breakdowns models.UsageReportBreakdowns) error {
+	execution, err := newUsageQueryExecution(func() (string, error) {
+		return startUsageReportQuery(monitoringContext, usageReport, breakdowns)
+	})
 	if err != nil {
 		return err
 	}
 
-	reportInstance.AthenaQueryId = queryId
-	err = db.InsertUsageReportInstance(monitoringContext, reportInstance)
+	return db.InsertUsageReportInstance(monitoringContext, models.UsageReportInstance{
+		Id:                  uuid2.New(),
+		UsageReportId:       usageReport.Id,
+		RequestedAt:         time.Now(),
+		Breakdowns:          breakdowns,
+		UsageQueryExecution: execution,
+	})
+}
 
-	return err
+// startUsageReportQuery counts the usage in the report's calendar month
+func startUsageReportQuery(monitoringContext *monitoring.Context, usageReport models.UsageReport, breakdowns models.UsageReportBreakdowns) (string, error) {
+	month := utils.GetMonth(usageReport.Year, usageReport.Month)
+	return UsageQueries.StartQuery(monitoringContext, usageReport.SubscriptionId, month, utils.ToNextMonth(month), breakdowns)
 }
 
 func GenerateMissingUsageReports(monitoringContext *monitoring.Context, subscription models.Subscription) ([]models.UsageReport, error) {
@@ -75,53 +66,93 @@ func GenerateMissingUsageReports(monitoringContext *monitoring.Context, subscrip
 	return currentUsageReports, nil
 }
 
-func CheckUsageReportInstances(monitoringContext *monitoring.Context, usageReportId uuid2.UUID) ([]models.UsageReportInstance, error) {
-	usageReportInstances, err := db.GetUsageReportInstances(monitoringContext, usageReportId)
-	if err != nil {
-		return nil, err
+// PollUsageReportInstance starts another query for the pending instance once a retry is due, or checks on its query
+// and ingests the results once it has completed.  The query backend is called before the instance is locked, so the
+// lock is only held while saving, and nothing is saved if another pod has moved the instance on in the meantime.  It
+// returns true when the instance is no longer pending.
+func PollUsageReportInstance(monitoringContext *monitoring.Context, instance models.UsageReportInstance) (finished bool, err error) {
+	startQuery := func() (string, error) {
+		exists, usageReport, err := db.GetUsageReport(monitoringContext, instance.UsageReportId)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("usage report %s for instance %s does not exist", instance.UsageReportId, instance.Id)
+		}
+
+		return startUsageReportQuery(monitoringContext, usageReport, instance.Breakdowns)
 	}
 
-	for i, instance := range usageReportInstances {
-		if instance.CompletedAt == nil {
-			execution, err := aws.AthenaClient.GetQueryExecution(monitoringContext, &athena.GetQueryExecutionInput{
-				QueryExecutionId: &instance.AthenaQueryId,
-			})
+	polled := instance
+	results, changed, err := pollUsageQueryExecution(monitoringContext, &polled.UsageQueryExecution, startQuery,
+		zap.String("usageReportInstanceId", instance.Id.String()))
+	if err != nil || !changed {
+		return false, err
+	}
+
+	saved := false
+	err = db.WithTransaction(monitoringContext, func(transaction *db.Transaction) error {
+		locked, current, err := db.LockPendingUsageReportInstance(monitoringContext, transaction, instance.Id)
+		if err != nil || !locked || !current.IsSameAttempt(instance.UsageQueryExecution) {
+			return err
+		}
+
+		if results != nil {
+			err = insertUsageReportInstanceResults(monitoringContext, transaction, polled, *results)
 			if err != nil {
-				return nil, err
+				return err
 			}
+		}
 
-			if execution.QueryExecution.Status.CompletionDateTime != nil {
-				results, err := aws.AthenaClient.GetQueryResults(monitoringContext, &athena.GetQueryResultsInput{
-					QueryExecutionId: &instance.AthenaQueryId,
-				})
-				if err != nil {
-					return nil, err
-				}
+		saved = true
+		return db.UpdateUsageReportInstance(monitoringContext, transaction, polled)
+	})
 
-				//TODO: Wrap inserting the rows and updating the completedat in a database transaction
+	return saved && err == nil && !polled.IsPending(), err
+}
 
-				//[1:] here to ignore the first row of results which is the header row
-				for _, row := range results.ResultSet.Rows[1:] {
-					err = db.InsertUsageReportInstanceProduct(monitoringContext, models.UsageReportInstanceProduct{
-						UsageReportInstanceId: instance.Id,
-						Product:               *row.Data[0].VarCharValue,
-						Value:                 utils.MustParseInt(*row.Data[1].VarCharValue),
-					})
-					if err != nil {
-						return nil, err
-					}
-				}
+func insertUsageReportInstanceResults(monitoringContext *monitoring.Context, transaction *db.Transaction, instance models.UsageReportInstance, results UsageResults) error {
+	for _, product := range results.Products {
+		err := db.InsertUsageReportInstanceProduct(monitoringContext, transaction, models.UsageReportInstanceProduct{
+			UsageReportInstanceId: instance.Id,
+			Product:               product.Product,
+			Value:                 product.Value,
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-				usageReportInstances[i].CompletedAt = utils.TimePtr(time.Now())
-				err = db.UpdateUsageReportInstance(monitoringContext, usageReportInstances[i])
-				if err != nil {
-					return nil, err
-				}
-			}
+	hours := make([]models.UsageReportInstanceHour, len(results.Series))
+	for i, hour := range results.Series {
+		hours[i] = models.UsageReportInstanceHour{
+			UsageReportInstanceId: instance.Id,
+			Product:               hour.Product,
+			Hour:                  hour.Hour,
+			Value:                 hour.Value,
 		}
 	}
+	err := db.InsertUsageReportInstanceHours(monitoringContext, transaction, hours)
+	if err != nil {
+		return err
+	}
 
-	return usageReportInstances, nil
+	for _, breakdown := range results.Breakdowns {
+		err := db.InsertUsageReportInstanceBreakdown(monitoringContext, transaction, models.UsageReportInstanceBreakdown{
+			UsageReportInstanceId: instance.Id,
+			Breakdown:             breakdown.Breakdown,
+			Product:               breakdown.Product,
+			AndroidId:             breakdown.AndroidId,
+			Method:                breakdown.Method,
+			Path:                  breakdown.Path,
+			Value:                 breakdown.Value,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func getMissingMonths(usageReports []models.UsageReport, subscription models.Subscription) []missingMonth {
@@ -152,119 +183,3 @@ func containsMonth(month time.Time, usageReports []models.UsageReport) bool {
 
 	return false
 }
-
-func setupTable(monitoringContext *monitoring.Context, report models.UsageReport) error {
-	tableName := getTableName(report.SubscriptionId.String(), report.Year, report.Month)
-	s3Location := getS3InputLocation(report.SubscriptionId.String(), report.Year, report.Month)
-
-	createTableDDL := fmt.Sprintf(`CREATE EXTERNAL TABLE IF NOT EXISTS %s (
-		id STRING,
-		occurred_at BIGINT,
-		product STRING,
-		method STRING,
-		path STRING,
-		android_id STRING,
-		subscription_id STRING
-	) ROW FORMAT SERDE 'org.openx.data.jsonserde.JsonSerDe' 
-	LOCATION '%s'`, tableName, s3Location)
-
-	ddlResponse, err := aws.AthenaClient.StartQueryExecution(monitoringContext, &athena.StartQueryExecutionInput{
-		QueryString: &createTableDDL,
-		QueryExecutionContext: &types.QueryExecutionContext{
-			Database: &config.GetConfig().AthenaConfig.DatabaseName,
-		},
-		WorkGroup: &config.GetConfig().AthenaConfig.WorkGroupName,
-		ResultConfiguration: &types.ResultConfiguration{
-			OutputLocation: utils.StringPtr(getS3OutputLocation()),
-		},
-	})
-	if err != nil {
-		monitoringContext.Error("Something went wrong issuing create table statement", zap.Error(err))
-		return err
-	}
-
-	err = pollForQueryCompletion(monitoringContext, *ddlResponse.QueryExecutionId)
-	if err != nil {
-		monitoringContext.Error("Something went wrong creating table", zap.Error(err))
-		return err
-	}
-
-	return nil
-}
-
-func createInstanceQuery(monitoringContext *monitoring.Context, report models.UsageReport) (queryId string, err error) {
-	tableName := getTableName(report.SubscriptionId.String(), report.Year, report.Month)
-	monthlyUsageQuery := fmt.Sprintf("SELECT product, COUNT(1) FROM %s GROUP BY product", tableName)
-
-	queryResponse, err := aws.AthenaClient.StartQueryExecution(monitoringContext, &athena.StartQueryExecutionInput{
-		QueryString: &monthlyUsageQuery,
-		QueryExecutionContext: &types.QueryExecutionContext{
-			Database: &config.GetConfig().AthenaConfig.DatabaseName,
-		},
-		WorkGroup: &config.GetConfig().AthenaConfig.WorkGroupName,
-		ResultConfiguration: &types.ResultConfiguration{
-			OutputLocation: utils.StringPtr(getS3OutputLocation()),
-		},
-	})
-	if err != nil {
-		return "", err
-	}
-
-	return *queryResponse.QueryExecutionId, nil
-}
-
-func pollForQueryCompletion(monitoringContext *monitoring.Context, id string) error {
-	monitoringContext.Info("Polling for query completion: " + id)
-	failedOrCancelled := false
-	check := func() error {
-		getQueryExecutionOutput, err := aws.AthenaClient.GetQueryExecution(monitoringContext, &athena.GetQueryExecutionInput{
-			QueryExecutionId: &id,
-		})
-		if err != nil {
-			return err
-		}
-
-		state := getQueryExecutionOutput.QueryExecution.Status.State
-
-		if state == types.QueryExecutionStateFailed || state == types.QueryExecutionStateCancelled {
-			failedOrCancelled = true
-			return nil
-		}
-
-		if state == types.QueryExecutionStateSucceeded {
-			return nil
-		}
-
-		return errors.New("query is still queued or running")
-	}
-
-	err := backoff.Retry(check, &backoff.ExponentialBackOff{
-		InitialInterval:     100 * time.Millisecond,
-		RandomizationFactor: 0.5,
-		Multiplier:          1.2,
-		MaxInterval:         1 * time.Second,
-		MaxElapsedTime:      5 * time.Second,
-		Stop:                -1,
-		Clock:               backoff.SystemClock,
-	})
-
-	if failedOrCancelled {
-		return fmt.Errorf("athena query %s was failed or cancelled", id)
-	}
-
-	return err
-}
-
-func getTableName(subscriptionId string, year int, month int) string {
-	return fmt.Sprintf("usage_report_%s_%s",
-		strings.ReplaceAll(subscriptionId, "-", "_"), utils.GetMonth(year, month).Format("2006_01"))
-}
-
-func getS3InputLocation(subscriptionId string, year int, month int) string {
-	return fmt.Sprintf("s3://%s/%s/%s/", config.GetConfig().AthenaConfig.InputBucketName,
-		subscriptionId, utils.GetMonth(year, month).Format("2006/01"))
-}
-
-func getS3OutputLocation() string {
-	return fmt.Sprintf("s3://%s/", config.GetConfig().AthenaConfig.OutputBucketName)
-}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FilesystemStore keeps each object as a file under a directory named after the bucket, so local runs and tests do
+// not need S3.  Metadata is kept in a JSON file per object in a separate directory so it never shows up in listings.
+type FilesystemStore struct {
+	directory         string
+	metadataDirectory string
+}
+
+func NewFilesystemStore(root string, bucket string) *FilesystemStore {
+	return &FilesystemStore{
+		directory:         filepath.Join(root, bucket),
+		metadataDirectory: filepath.Join(root, ".metadata", bucket),
+	}
+}
+
+func (s *FilesystemStore) path(key string) string {
+	return filepath.Join(s.directory, filepath.FromSlash(key))
+}
+
+// List walks the deepest directory the prefix names, as the rest of the prefix can only match part of a file name.
+// The token is the last key of the previous page.
+func (s *FilesystemStore) List(ctx context.Context, prefix string, token *string, maxKeys int) (ObjectPage, error) {
+	walkFrom := s.directory
+	if lastSlash := strings.LastIndex(prefix, "/"); lastSlash >= 0 {
+		walkFrom = s.path(prefix[:lastSlash])
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(walkFrom, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(s.directory, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) || (token != nil && key <= *token) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return ObjectPage{}, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	page := ObjectPage{Objects: objects}
+	if maxKeys > 0 && len(objects) > maxKeys {
+		page.Objects = objects[:maxKeys]
+		page.NextToken = &page.Objects[maxKeys-1].Key
+	}
+
+	return page, nil
+}
+
+func (s *FilesystemStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	return file, err
+}
+
+func (s *FilesystemStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	if err := s.write(s.path(key), body); err != nil {
+		return err
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	return s.write(filepath.Join(s.metadataDirectory, filepath.FromSlash(key)+".json"), strings.NewReader(string(encoded)))
+}
+
+// PutMultipart is the same as Put as the body is streamed straight to disk either way
+func (s *FilesystemStore) PutMultipart(ctx context.Context, key string, body io.Reader) error {
+	return s.write(s.path(key), body)
+}
+
+// write copies the body into a temporary file next to the destination and renames it into place, so a failed write
+// never leaves a partial object behind
+func (s *FilesystemStore) write(path string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := io.Copy(temporary, body); err != nil {
+		temporary.Close()
+		return err
+	}
+
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary.Name(), path)
+}
+
+func (s *FilesystemStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(s.metadataDirectory, filepath.FromSlash(key)+".json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Presign returns a file URL, which is only any use on the machine the store is on
+func (s *FilesystemStore) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, err := os.Stat(s.path(key)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return "", err
+	}
+
+	absolute, err := filepath.Abs(s.path(key))
+	if err != nil {
+		return "", err
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(absolute)}).String(), nil
+}
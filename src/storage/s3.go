@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"time"
+)
+
+type S3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+func NewS3Store(client *s3.Client, bucket string) *S3Store {
+	return &S3Store{client: client, bucket: bucket}
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string, token *string, maxKeys int) (ObjectPage, error) {
+	response, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:            &s.bucket,
+		ContinuationToken: token,
+		MaxKeys:           int32(maxKeys),
+		Prefix:            &prefix,
+	})
+	if err != nil {
+		return ObjectPage{}, err
+	}
+
+	page := ObjectPage{NextToken: response.NextContinuationToken}
+	for _, objectInfo := range response.Contents {
+		page.Objects = append(page.Objects, ObjectInfo{Key: *objectInfo.Key, Size: objectInfo.Size})
+	}
+
+	return page, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	response, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		Body:     body,
+		Metadata: metadata,
+	})
+
+	return err
+}
+
+func (s *S3Store) PutMultipart(ctx context.Context, key string, body io.Reader) error {
+	uploader := manager.NewUploader(s.client, func(u *manager.Uploader) {
+		u.Concurrency = 1
+		u.LeavePartsOnError = false
+	})
+
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		Body:   body,
+	})
+
+	return err
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+
+	return err
+}
+
+func (s *S3Store) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	request, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+
+	return request.URL, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"subscriptions/src/aws"
+	"subscriptions/src/config"
+	"time"
+)
+
+// ErrNotFound is returned by Get when there is no object with the key
+var ErrNotFound = errors.New("object not found")
+
+// AccessLogs is the store for the access log bucket, set up by SetupStorage from the profile
+var AccessLogs ObjectStore
+
+// UsageExports is the store for the bucket Athena writes query results to, where usage report exports are kept too
+var UsageExports ObjectStore
+
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// ObjectPage is one page of a listing, NextToken is nil once there are no more
+type ObjectPage struct {
+	Objects   []ObjectInfo
+	NextToken *string
+}
+
+// ObjectStore holds objects by key within a single bucket or directory.  Keys use / as the separator whatever the
+// backend.
+type ObjectStore interface {
+	// List returns up to maxKeys objects whose keys start with prefix, in key order.  Pass the NextToken from one page
+	// to get the next.
+	List(ctx context.Context, prefix string, token *string, maxKeys int) (ObjectPage, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put writes the object in one request, with metadata stored alongside it
+	Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error
+	// PutMultipart streams a body of unknown length into the object, holding no more than one part in memory.  Nothing
+	// is left behind if reading the body fails.
+	PutMultipart(ctx context.Context, key string, body io.Reader) error
+	// Delete removes the object, it is not an error if it does not exist
+	Delete(ctx context.Context, key string) error
+	// Presign returns a URL the object can be downloaded from without credentials until it expires
+	Presign(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// ForEachObject lists every object under the prefix a page at a time, calling action with each
+func ForEachObject(ctx context.Context, store ObjectStore, prefix string, action func(object ObjectInfo)) error {
+	var token *string
+	for {
+		page, err := store.List(ctx, prefix, token, 1000)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range page.Objects {
+			action(object)
+		}
+
+		token = page.NextToken
+
+		if token == nil {
+			return nil
+		}
+	}
+}
+
+// SetupStorage creates the stores for the backend in the profile.  The S3 backend needs SetupAWS to have been called.
+func SetupStorage() {
+	storageConfig := config.GetConfig().StorageConfig
+	accessLogBucket := config.GetConfig().BucketConfig.AccessLogBucket
+	outputBucket := config.GetConfig().AthenaConfig.OutputBucketName
+
+	switch storageConfig.Backend {
+	case config.StorageBackendFilesystem:
+		AccessLogs = NewFilesystemStore(storageConfig.FilesystemRoot, accessLogBucket)
+		UsageExports = NewFilesystemStore(storageConfig.FilesystemRoot, outputBucket)
+	default:
+		AccessLogs = NewS3Store(aws.S3Client, accessLogBucket)
+		UsageExports = NewS3Store(aws.S3Client, outputBucket)
+	}
+}
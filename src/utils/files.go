@@ -1,17 +0,0 @@
-package utils
-
-import (
-	"errors"
-	"os"
-)
-
-func FileExists(name string) bool {
-	_, err := os.Stat(name)
-	if err == nil {
-		return true
-	}
-	if errors.Is(err, os.ErrNotExist) {
-		return false
-	}
-	return false
-}
@@ -9,3 +9,9 @@ var apiClient = &api.Client{
 	Server: "http://localhost:8020",
 	Client: http.DefaultClient,
 }
+
+// parquetApiClient is the same app running with the integration test profile, but compacting to Parquet
+var parquetApiClient = &api.Client{
+	Server: "http://localhost:8021",
+	Client: http.DefaultClient,
+}
@@ -0,0 +1,40 @@
+package integration_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"subscriptions/test/integration/helper"
+	"testing"
+)
+
+// These run the cron jobs on the app compacting to Parquet, which shares the database and buckets with the app the
+// other tests use
+
+func TestCompactedDayIsCopiedToParquet(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	runCronJobOn(t, parquetApiClient, "access-log-compaction", false)
+
+	parquetBytes := helper.ReadS3Object(t, "factory-access-log-bucket-int-test", "parquet/14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.parquet")
+	require.Equal(t, "PAR1", string(parquetBytes[:4]))
+	require.Equal(t, "PAR1", string(parquetBytes[len(parquetBytes)-4:]))
+}
+
+func TestClosedMonthIsRolledUpIntoParquetMonthParts(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	runCronJobOn(t, parquetApiClient, "access-log-compaction", false)
+
+	runCronJobOn(t, parquetApiClient, "access-log-monthly-rollup", false)
+
+	// The Parquet copies of the day objects are replaced by a copy of each month part
+	parquetObjects := helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "parquet/14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/")
+	require.Equal(t, []string{"parquet/14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/month/attempt-1-part-0000.parquet"}, parquetObjects)
+}
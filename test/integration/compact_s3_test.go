@@ -5,7 +5,7 @@ import (
 	"compress/gzip"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
-	"net/http"
+	"strings"
 	"subscriptions/test/integration/helper"
 	"testing"
 )
@@ -17,10 +17,7 @@ func TestSmallFilesAreCompactedForEachDaySinceSubscriptionWasCreatedWhenNoCompac
 	helper.ResetAws(t)
 	helper.RunTestSetupScript("compact-subscription.sql")
 
-	_, err := http.DefaultClient.Post("http://localhost:8020/cron?cronName=access-log-compaction", "", nil)
-	if err != nil {
-		t.Fatal("Failed to call cron trigger endpoint", err)
-	}
+	runCronJob(t, "access-log-compaction", false)
 
 	gzippedBytes := helper.ReadS3Object(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.gz")
 
@@ -49,3 +46,75 @@ func TestSmallFilesAreCompactedForEachDaySinceSubscriptionWasCreatedWhenNoCompac
 {"Id":  "26c133b9-c7dd-4d72-83d3-daa3f4dabec8", "OccurredAt": 12345, "Product": "Main Product", "Method": "POST", "Path": "/yes/yes", "AndroidId": "f190e8c9-7c62-4d8a-8296-67a100a1f116", "SubscriptionId": "14fb4f6e-1298-4ca5-989d-00b56a2c6564"}
 `, jsonLines)
 }
+
+func TestDryRunCompactionLeavesSmallFilesInPlace(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	before := helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/")
+
+	runCronJob(t, "access-log-compaction", true)
+
+	after := helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/")
+	require.ElementsMatch(t, before, after)
+	require.NotContains(t, after, "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.gz")
+}
+
+func TestCompactedDayIsNotCopiedToParquetByDefault(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	runCronJob(t, "access-log-compaction", false)
+
+	require.Empty(t, helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "parquet/"))
+}
+
+func TestSmallObjectsListedAfterTheDayObjectAreCompactedIntoAnotherDayObject(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	runCronJob(t, "access-log-compaction", false)
+
+	// As if the ledger update failed after the day object was written, with a late object arriving before the retry
+	helper.RunTestSetupScript("retry-compacted-day.sql")
+	helper.PutS3Object(t, "./small-files/late.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/late.gz")
+
+	runCronJob(t, "access-log-compaction", false)
+
+	objects := helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/")
+	require.NotContains(t, objects, "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/late.gz")
+	require.Contains(t, objects, "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.gz")
+
+	var lateDayObjects []string
+	for _, key := range objects {
+		if strings.HasPrefix(key, "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day-") {
+			lateDayObjects = append(lateDayObjects, key)
+		}
+	}
+	require.Len(t, lateDayObjects, 1)
+
+	reader, err := gzip.NewReader(bytes.NewBuffer(helper.ReadS3Object(t, "factory-access-log-bucket-int-test", lateDayObjects[0])))
+	if err != nil {
+		t.Fatal("Could not read gzip", err)
+	}
+	defer reader.Close()
+
+	ungzipped, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal("Could not read gzip", err)
+	}
+
+	// The record already in day.gz is dropped as a duplicate, only the new one is compacted
+	require.Equal(t,
+		`{"Id":  "3d1c2b7e-5b0a-4f57-9a53-4b7f0b3c9e21", "OccurredAt": 12345, "Product": "Main Product", "Method": "POST", "Path": "/yes/yes", "AndroidId": "f190e8c9-7c62-4d8a-8296-67a100a1f116", "SubscriptionId": "14fb4f6e-1298-4ca5-989d-00b56a2c6564"}
+`, string(ungzipped))
+}
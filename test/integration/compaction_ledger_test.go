@@ -0,0 +1,188 @@
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"subscriptions/src/api"
+	"subscriptions/test/integration/helper"
+	"testing"
+)
+
+func TestCompactionLedgerRecordsEachCompactedDay(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+	helper.RunTestSetupScript("compaction-ledger-api-key.sql")
+
+	runCronJob(t, "access-log-compaction", false)
+
+	helper.ReadS3Object(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.gz")
+
+	from := int64(1655510400)
+	to := int64(1655510400)
+	resp, err := apiClient.GetSubscriptionsSubscriptionIdCompactions(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564",
+		&api.GetSubscriptionsSubscriptionIdCompactionsParams{From: &from, To: &to},
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "compaction-ledger-key")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 200, resp.StatusCode)
+
+	var compactionDays []api.CompactionDay
+	err = json.NewDecoder(resp.Body).Decode(&compactionDays)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, len(compactionDays))
+	require.Equal(t, from, compactionDays[0].Day)
+	require.Equal(t, "succeeded", compactionDays[0].Status)
+	require.Equal(t, 2, compactionDays[0].SourceObjectCount)
+	require.Equal(t, int64(8), compactionDays[0].RecordCount)
+	require.Equal(t, "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.gz", *compactionDays[0].OutputKey)
+	require.Equal(t, 1, compactionDays[0].Attempts)
+	require.Equal(t, int64(0), compactionDays[0].DuplicateCount)
+	require.NotNil(t, compactionDays[0].ContentSha256)
+}
+
+func TestCompactionDropsRecordsWithDuplicateIds(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.PutS3Object(t, "./small-files/2.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/5.gz")
+	helper.RunTestSetupScript("compact-subscription.sql")
+	helper.RunTestSetupScript("compaction-ledger-api-key.sql")
+
+	runCronJob(t, "access-log-compaction", false)
+
+	helper.ReadS3Object(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.gz")
+
+	from := int64(1655510400)
+	to := int64(1655510400)
+	resp, err := apiClient.GetSubscriptionsSubscriptionIdCompactions(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564",
+		&api.GetSubscriptionsSubscriptionIdCompactionsParams{From: &from, To: &to},
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "compaction-ledger-key")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 200, resp.StatusCode)
+
+	var compactionDays []api.CompactionDay
+	err = json.NewDecoder(resp.Body).Decode(&compactionDays)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, len(compactionDays))
+	require.Equal(t, 3, compactionDays[0].SourceObjectCount)
+	require.Equal(t, int64(8), compactionDays[0].RecordCount)
+	require.Equal(t, int64(4), compactionDays[0].DuplicateCount)
+}
+
+func TestCompactionRoutesInvalidRecordsToDeadLetterPrefix(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.PutS3Object(t, "./small-files/invalid-lines.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/5.gz")
+	helper.PutS3Object(t, "./small-files/corrupt.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/6.gz")
+	helper.RunTestSetupScript("compact-subscription.sql")
+	helper.RunTestSetupScript("compaction-ledger-api-key.sql")
+
+	runCronJob(t, "access-log-compaction", false)
+
+	helper.ReadS3Object(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/day.gz")
+	helper.ReadS3Object(t, "factory-access-log-bucket-int-test", "dead-letter/14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/objects/6.gz")
+	deadLetterLines := helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "dead-letter/14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/lines-")
+	require.Equal(t, 1, len(deadLetterLines))
+
+	from := int64(1655510400)
+	to := int64(1655510400)
+	resp, err := apiClient.GetSubscriptionsSubscriptionIdCompactions(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564",
+		&api.GetSubscriptionsSubscriptionIdCompactionsParams{From: &from, To: &to},
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "compaction-ledger-key")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 200, resp.StatusCode)
+
+	var compactionDays []api.CompactionDay
+	err = json.NewDecoder(resp.Body).Decode(&compactionDays)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, len(compactionDays))
+	require.Equal(t, "succeeded", compactionDays[0].Status)
+	require.Equal(t, 4, compactionDays[0].SourceObjectCount)
+	require.Equal(t, int64(9), compactionDays[0].RecordCount)
+	require.Equal(t, int64(2), compactionDays[0].DeadLetterCount)
+	require.Equal(t, 1, compactionDays[0].UnreadableObjectCount)
+}
+
+func TestCompactionLedgerWithoutPermissionReturns403(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.RunTestSetupScript("api-keys.sql")
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	resp, err := apiClient.GetSubscriptionsSubscriptionIdCompactions(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564",
+		&api.GetSubscriptionsSubscriptionIdCompactionsParams{},
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "valid-key-no-permission")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 403, resp.StatusCode)
+}
+
+func TestCompactionLedgerIsBackfilledFromTheCheckpointItReplaced(t *testing.T) {
+	// The last migration before the ledger replaced the checkpoint
+	helper.ResetDatabaseToVersion(6)
+	helper.RunTestSetupScript("compaction-checkpoint.sql")
+	helper.MigrateDatabase()
+
+	rows, err := helper.GetDatabaseConnection().Query(`
+		SELECT subscription_id, to_char(day, 'YYYY-MM-DD'), status FROM compaction_day ORDER BY subscription_id, day`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var days []string
+	for rows.Next() {
+		var subscriptionId, day, status string
+		require.NoError(t, rows.Scan(&subscriptionId, &day, &status))
+		days = append(days, subscriptionId+" "+day+" "+status)
+	}
+	require.NoError(t, rows.Err())
+
+	// Only the Subscription which never failed can be trusted to have compacted every day before its last success
+	require.Equal(t, []string{
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564 2022-06-14 succeeded",
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564 2022-06-15 succeeded",
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564 2022-06-16 succeeded",
+	}, days)
+}
@@ -0,0 +1,167 @@
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"subscriptions/src/api"
+	"subscriptions/test/integration/helper"
+	"testing"
+	"time"
+)
+
+func withCronJobsKey(ctx context.Context, req *http.Request) error {
+	req.Header.Add("X-Api-Key", "cron-jobs-key")
+	return nil
+}
+
+// runCronJob triggers a run of the job through the API and waits for it to finish
+func runCronJob(t *testing.T, name string, dryRun bool) api.CronJobRun {
+	return runCronJobOn(t, apiClient, name, dryRun)
+}
+
+// runCronJobOn is runCronJob with the run triggered on the app client talks to
+func runCronJobOn(t *testing.T, client *api.Client, name string, dryRun bool) api.CronJobRun {
+	helper.RunTestSetupScript("cron-jobs-api-key.sql")
+
+	resp, err := client.PostCronJobsCronJobNameRuns(context.Background(), name,
+		&api.PostCronJobsCronJobNameRunsParams{DryRun: &dryRun}, withCronJobsKey)
+	if err != nil {
+		t.Fatal("Failed to call cron trigger endpoint", err)
+	}
+	require.Equal(t, 202, resp.StatusCode)
+
+	var run api.CronJobRun
+	if err := json.NewDecoder(resp.Body).Decode(&run); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 0; attempt < 60; attempt++ {
+		for _, finished := range getCronJobRuns(t, name) {
+			if finished.Id == run.Id && finished.Status != "running" {
+				return finished
+			}
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	t.Fatal("Cron job run did not finish", name)
+	return run
+}
+
+func getCronJobRuns(t *testing.T, name string) []api.CronJobRun {
+	resp, err := apiClient.GetCronJobsCronJobNameRuns(context.Background(), name,
+		&api.GetCronJobsCronJobNameRunsParams{}, withCronJobsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 200, resp.StatusCode)
+
+	var runs []api.CronJobRun
+	if err := json.NewDecoder(resp.Body).Decode(&runs); err != nil {
+		t.Fatal(err)
+	}
+
+	return runs
+}
+
+func TestCronJobRunIsRecorded(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	run := runCronJob(t, "access-log-compaction", false)
+
+	require.Equal(t, "succeeded", run.Status)
+	require.Equal(t, "manual", run.Trigger)
+	require.NotNil(t, run.EndedAt)
+	require.Nil(t, run.Error)
+	require.Equal(t, int64(1), run.Summary.AdditionalProperties["subscriptions"])
+	require.Equal(t, int64(1), run.Summary.AdditionalProperties["succeeded"])
+
+	runs := getCronJobRuns(t, "access-log-compaction")
+	require.Equal(t, 1, len(runs))
+	require.Equal(t, run.Id, runs[0].Id)
+}
+
+func TestCronJobCanBeRunAgainOnceItHasFinished(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	first := runCronJob(t, "access-log-compaction", false)
+	second := runCronJob(t, "access-log-compaction", false)
+
+	require.Equal(t, "succeeded", first.Status)
+	require.Equal(t, "succeeded", second.Status)
+	require.NotEqual(t, first.Id, second.Id)
+	require.Equal(t, 2, len(getCronJobRuns(t, "access-log-compaction")))
+}
+
+func TestCronJobsAreListedWithTheirLastRun(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	run := runCronJob(t, "access-log-compaction", true)
+
+	resp, err := apiClient.GetCronJobs(context.Background(), withCronJobsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 200, resp.StatusCode)
+
+	var jobs []api.CronJob
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	jobsByName := make(map[string]api.CronJob, len(jobs))
+	for _, job := range jobs {
+		jobsByName[job.Name] = job
+	}
+
+	require.Contains(t, jobsByName, "access-log-compaction")
+	require.Contains(t, jobsByName, "access-log-monthly-rollup")
+	require.Equal(t, run.Id, jobsByName["access-log-compaction"].LastRun.Id)
+	require.Nil(t, jobsByName["access-log-monthly-rollup"].LastRun)
+}
+
+func TestUnknownCronJobCannotBeTriggered(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.RunTestSetupScript("cron-jobs-api-key.sql")
+
+	resp, err := apiClient.PostCronJobsCronJobNameRuns(context.Background(), "no-such-job",
+		&api.PostCronJobsCronJobNameRunsParams{}, withCronJobsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 404, resp.StatusCode)
+}
+
+func TestCronJobsCannotBeTriggeredWithoutPermission(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.RunTestSetupScript("api-keys.sql")
+
+	resp, err := apiClient.PostCronJobsCronJobNameRuns(context.Background(), "access-log-compaction",
+		&api.PostCronJobsCronJobNameRunsParams{}, func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "valid-key-with-permission")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 403, resp.StatusCode)
+}
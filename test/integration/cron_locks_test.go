@@ -0,0 +1,173 @@
+package integration_test
+
+import (
+	uuid2 "github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"subscriptions/src/cron"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/test/integration/helper"
+	"testing"
+	"time"
+)
+
+// The jobs in these tests are only ever run by the test process, so the apps never touch their locks
+const testCronName = "integration-test-lease"
+
+func newCronJobRun() models.CronJobRun {
+	return models.CronJobRun{
+		Id:        uuid2.New(),
+		Name:      testCronName,
+		Host:      "integration-test",
+		Trigger:   models.CronJobRunManual,
+		Status:    models.CronJobRunRunning,
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+func expireCronLock(t *testing.T, name string) {
+	_, err := helper.GetDatabaseConnection().Exec(`
+		UPDATE cron_job_lock SET locked_until = NOW() AT TIME ZONE 'UTC' - INTERVAL '1 SECOND' WHERE name = $1`, name)
+	require.NoError(t, err)
+}
+
+// takeOverCronLock does what another pod acquiring the lock would, without waiting for the lease to run out first
+func takeOverCronLock(t *testing.T, name string) {
+	_, err := helper.GetDatabaseConnection().Exec(`
+		UPDATE cron_job_lock SET locked_by = 'another-pod', fencing_token = fencing_token + 1,
+			locked_until = NOW() AT TIME ZONE 'UTC' + INTERVAL '1 HOUR'
+		WHERE name = $1`, name)
+	require.NoError(t, err)
+}
+
+func cronJobRunExists(t *testing.T, runId uuid2.UUID) bool {
+	var exists bool
+	err := helper.GetDatabaseConnection().QueryRow(`SELECT EXISTS (SELECT FROM cron_job_run WHERE id = $1)`, runId).
+		Scan(&exists)
+	require.NoError(t, err)
+
+	return exists
+}
+
+func TestCronLockWriteWithStaleFencingTokenIsRejected(t *testing.T) {
+	helper.ResetDatabase()
+	helper.ConnectAppDatabase()
+
+	stale, acquired, err := db.AcquireCronLock(monitoring.GlobalContext, testCronName, "pod-a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	expireCronLock(t, testCronName)
+
+	current, acquired, err := db.AcquireCronLock(monitoring.GlobalContext, testCronName, "pod-b", time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	require.Greater(t, current.FencingToken, stale.FencingToken)
+
+	staleRun := newCronJobRun()
+	err = db.StartCronJobRun(monitoring.GlobalContext, stale, staleRun)
+	require.ErrorIs(t, err, db.ErrCronLockLost)
+	require.False(t, cronJobRunExists(t, staleRun.Id))
+
+	require.ErrorIs(t, db.RenewCronLock(monitoring.GlobalContext, stale, time.Minute), db.ErrCronLockLost)
+
+	// Releasing with the stale token must leave the current holder's lease alone
+	require.NoError(t, db.ReleaseCronLock(monitoring.GlobalContext, stale))
+	_, acquired, err = db.AcquireCronLock(monitoring.GlobalContext, testCronName, "pod-c", time.Minute)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	currentRun := newCronJobRun()
+	require.NoError(t, db.StartCronJobRun(monitoring.GlobalContext, current, currentRun))
+	require.True(t, cronJobRunExists(t, currentRun.Id))
+}
+
+func TestCronLockWriteAfterTheLeaseRunsOutIsRejected(t *testing.T) {
+	helper.ResetDatabase()
+	helper.ConnectAppDatabase()
+
+	lock, acquired, err := db.AcquireCronLock(monitoring.GlobalContext, testCronName, "pod-a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	expireCronLock(t, testCronName)
+
+	run := newCronJobRun()
+	require.ErrorIs(t, db.StartCronJobRun(monitoring.GlobalContext, lock, run), db.ErrCronLockLost)
+	require.False(t, cronJobRunExists(t, run.Id))
+	require.ErrorIs(t, db.RenewCronLock(monitoring.GlobalContext, lock, time.Minute), db.ErrCronLockLost)
+}
+
+// waitForCronJobRun waits for the run of the test job to finish, returning how it did
+func waitForCronJobRun(t *testing.T, runId uuid2.UUID) models.CronJobRun {
+	var finished models.CronJobRun
+	require.Eventually(t, func() bool {
+		runs, err := db.GetCronJobRuns(monitoring.GlobalContext, testCronName, 1)
+		require.NoError(t, err)
+
+		if len(runs) == 1 && runs[0].Id == runId && runs[0].Status != models.CronJobRunRunning {
+			finished = runs[0]
+			return true
+		}
+
+		return false
+	}, 15*time.Second, 100*time.Millisecond)
+
+	return finished
+}
+
+func TestCronJobRunningForLongerThanItsLeaseKeepsItsLock(t *testing.T) {
+	helper.ResetDatabase()
+	helper.ConnectAppDatabase()
+
+	job := cron.Job{
+		Name:      testCronName,
+		Timeout:   time.Minute,
+		LockLease: 3 * time.Second,
+		Run: func(monitoringContext *monitoring.Context, lock models.CronLock, parameters url.Values) (models.CronJobRunSummary, error) {
+			time.Sleep(5 * time.Second)
+
+			// Only possible if the heartbeat has kept the lease alive
+			return nil, db.RenewCronLock(monitoringContext, lock, time.Second)
+		},
+	}
+
+	run, started, err := cron.TriggerJob(job, url.Values{})
+	require.NoError(t, err)
+	require.True(t, started)
+
+	finished := waitForCronJobRun(t, run.Id)
+	require.Equal(t, models.CronJobRunSucceeded, finished.Status)
+	require.Nil(t, finished.Error)
+}
+
+func TestCronJobIsCancelledWhenItsLockIsTakenOverMidRun(t *testing.T) {
+	helper.ResetDatabase()
+	helper.ConnectAppDatabase()
+
+	running := make(chan struct{})
+	job := cron.Job{
+		Name:      testCronName,
+		Timeout:   time.Minute,
+		LockLease: 3 * time.Second,
+		Run: func(monitoringContext *monitoring.Context, lock models.CronLock, parameters url.Values) (models.CronJobRunSummary, error) {
+			close(running)
+			<-monitoringContext.Done()
+			return nil, monitoringContext.Err()
+		},
+	}
+
+	run, started, err := cron.TriggerJob(job, url.Values{})
+	require.NoError(t, err)
+	require.True(t, started)
+
+	<-running
+	takeOverCronLock(t, testCronName)
+
+	// The next heartbeat finds the lease gone and cancels the job, rather than it running on until its timeout
+	finished := waitForCronJobRun(t, run.Id)
+	require.Equal(t, models.CronJobRunFailed, finished.Status)
+	require.Equal(t, db.ErrCronLockLost.Error(), *finished.Error)
+}
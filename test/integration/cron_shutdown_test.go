@@ -0,0 +1,92 @@
+package integration_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"os"
+	"os/exec"
+	"subscriptions/src/cron"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/test/integration/helper"
+	"testing"
+	"time"
+)
+
+const (
+	cooperativeCronName = "integration-test-cooperative"
+	stuckCronName       = "integration-test-stuck"
+)
+
+// StopCronJobs stops every run in the process for good, so the test runs it in a child process of the test binary
+// rather than stopping the jobs the other tests trigger
+func TestStopCronJobsCancelsRunsThenReleasesLocksOnceTheDeadlinePasses(t *testing.T) {
+	if os.Getenv("STOP_CRON_JOBS_CHILD") == "1" {
+		stopCronJobsWithAStuckRun(t)
+		return
+	}
+
+	helper.ResetDatabase()
+	helper.ConnectAppDatabase()
+
+	child := exec.Command(os.Args[0], "-test.run=^TestStopCronJobsCancelsRunsThenReleasesLocksOnceTheDeadlinePasses$")
+	child.Env = append(os.Environ(), "STOP_CRON_JOBS_CHILD=1")
+	output, err := child.CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	// The run which stopped when told to has recorded so, and both locks are free for another pod straight away
+	runs, err := db.GetCronJobRuns(monitoring.GlobalContext, cooperativeCronName, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(runs))
+	require.Equal(t, models.CronJobRunCancelled, runs[0].Status)
+
+	for _, name := range []string{cooperativeCronName, stuckCronName} {
+		_, acquired, err := db.AcquireCronLock(monitoring.GlobalContext, name, "another-pod", time.Minute)
+		require.NoError(t, err)
+		require.True(t, acquired, "lock for %s was not released", name)
+	}
+}
+
+func stopCronJobsWithAStuckRun(t *testing.T) {
+	helper.ConnectAppDatabase()
+
+	cooperative := cron.Job{
+		Name:      cooperativeCronName,
+		Timeout:   time.Hour,
+		LockLease: time.Hour,
+		Run: func(monitoringContext *monitoring.Context, lock models.CronLock, parameters url.Values) (models.CronJobRunSummary, error) {
+			<-monitoringContext.Done()
+			return nil, monitoringContext.Err()
+		},
+	}
+
+	stuck := cron.Job{
+		Name:      stuckCronName,
+		Timeout:   time.Hour,
+		LockLease: time.Hour,
+		Run: func(monitoringContext *monitoring.Context, lock models.CronLock, parameters url.Values) (models.CronJobRunSummary, error) {
+			select {}
+		},
+	}
+
+	for _, job := range []cron.Job{cooperative, stuck} {
+		_, started, err := cron.TriggerJob(job, url.Values{})
+		require.NoError(t, err)
+		require.True(t, started)
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	stopping := time.Now()
+	cron.StopCronJobs(deadline)
+
+	// The stuck run would hold its lock for an hour if shutdown waited on it
+	require.Less(t, time.Since(stopping), 3*time.Second)
+
+	_, started, err := cron.TriggerJob(cooperative, url.Values{})
+	require.ErrorIs(t, err, cron.ErrShuttingDown)
+	require.False(t, started)
+}
@@ -13,10 +13,13 @@ import (
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"go.uber.org/zap"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	appdb "subscriptions/src/database"
+	"subscriptions/src/monitoring"
 	"subscriptions/src/utils"
 	db "subscriptions/test/integration/db"
 	"testing"
@@ -25,6 +28,8 @@ import (
 
 var s3Client *s3.Client
 
+var appDatabaseConnected bool
+
 var dropStatements = readFile("../../database/drop-all-tables.sql")
 
 func readFile(file string) string {
@@ -39,16 +44,23 @@ func ResetDatabase() {
 	initIfNeeded()
 
 	execOrPanic(dropStatements)
-	driver, err := postgres.WithInstance(db.DbConnection, &postgres.Config{})
+	MigrateDatabase()
+}
+
+// ResetDatabaseToVersion empties the database and only runs the migrations up to and including version, so tests can
+// set up data the way it was before a later migration.  MigrateDatabase runs the rest.
+func ResetDatabaseToVersion(version uint) {
+	initIfNeeded()
+
+	execOrPanic(dropStatements)
+	err := newMigrate().Migrate(version)
 	if err != nil {
-		log.Panicf("Could not create migration driver: %s", err)
+		log.Fatalf("Could not migrate database to version %d: %s", version, err)
 	}
+}
 
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://../../database/migrations",
-		"postgres", driver)
-
-	err = m.Up()
+func MigrateDatabase() {
+	err := newMigrate().Up()
 	if err != nil {
 		if err == migrate.ErrNoChange {
 			log.Println("No migrations to run, up to date")
@@ -58,6 +70,22 @@ func ResetDatabase() {
 	}
 }
 
+func newMigrate() *migrate.Migrate {
+	driver, err := postgres.WithInstance(db.DbConnection, &postgres.Config{})
+	if err != nil {
+		log.Panicf("Could not create migration driver: %s", err)
+	}
+
+	m, err := migrate.NewWithDatabaseInstance(
+		"file://../../database/migrations",
+		"postgres", driver)
+	if err != nil {
+		log.Panicf("Could not read migrations: %s", err)
+	}
+
+	return m
+}
+
 func RunTestSetupScript(fileName string) {
 	initIfNeeded()
 
@@ -113,6 +141,25 @@ func execOrPanic(statement string) {
 	}
 }
 
+// ConnectAppDatabase points the server's database package at the integration test database, so tests can call it
+// directly.  It does not migrate, so ResetDatabase must have been called first.
+func ConnectAppDatabase() {
+	if monitoring.GlobalContext == nil {
+		monitoring.GlobalContext = monitoring.NewMonitoringContext(zap.NewNop(), context.Background())
+	}
+
+	if appDatabaseConnected {
+		return
+	}
+
+	err := appdb.Connect("postgres", "integration-test-pa55word!", "subscriptions", "localhost", 1334)
+	if err != nil {
+		log.Panicf("Could not connect the server's database package for integration tests: %s", err)
+	}
+
+	appDatabaseConnected = true
+}
+
 func initIfNeeded() {
 	if db.DbConnection == nil {
 		err := db.Initialize(
@@ -223,30 +270,8 @@ func WaitForS3(t *testing.T) {
 }
 
 func ResetAws(t *testing.T) {
-	buckets, err := s3Client.ListBuckets(context.Background(), &s3.ListBucketsInput{})
-	if err != nil {
-		t.Fatal("Unable to list buckets", err)
-	}
-
-	found := false
-	for _, bucket := range buckets.Buckets {
-		if *bucket.Name == "factory-access-log-bucket-int-test" {
-			found = true
-		}
-	}
-
-	if !found {
-		_, err := s3Client.CreateBucket(context.Background(), &s3.CreateBucketInput{
-			Bucket: utils.StringPtr("factory-access-log-bucket-int-test"),
-			ACL:    "public-read-write",
-			CreateBucketConfiguration: &types.CreateBucketConfiguration{
-				LocationConstraint: types.BucketLocationConstraintEuWest1,
-			},
-		})
-		if err != nil {
-			t.Fatal("Could not create bucket", err)
-		}
-	}
+	ensureBucket(t, "factory-access-log-bucket-int-test")
+	ensureBucket(t, UsageExportBucket)
 
 	objects, err := s3Client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
 		Bucket: utils.StringPtr("factory-access-log-bucket-int-test"),
@@ -265,13 +290,50 @@ func ResetAws(t *testing.T) {
 		}
 	}
 
-	putFileS3(t, "./small-files/1.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/17/1.gz")
-	putFileS3(t, "./small-files/2.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/2.gz")
-	putFileS3(t, "./small-files/3.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/3.gz")
-	putFileS3(t, "./small-files/4.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/19/4.gz")
+	putFileS3(t, "factory-access-log-bucket-int-test", "./small-files/1.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/17/1.gz")
+	putFileS3(t, "factory-access-log-bucket-int-test", "./small-files/2.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/2.gz")
+	putFileS3(t, "factory-access-log-bucket-int-test", "./small-files/3.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/18/3.gz")
+	putFileS3(t, "factory-access-log-bucket-int-test", "./small-files/4.gz", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/19/4.gz")
 }
 
-func putFileS3(t *testing.T, fileName string, s3Location string) {
+// UsageExportBucket is the Athena output bucket in the integration test profile, where usage report exports are written
+const UsageExportBucket = "factory-athena-output-bucket-int-test"
+
+func ensureBucket(t *testing.T, name string) {
+	buckets, err := s3Client.ListBuckets(context.Background(), &s3.ListBucketsInput{})
+	if err != nil {
+		t.Fatal("Unable to list buckets", err)
+	}
+
+	for _, bucket := range buckets.Buckets {
+		if *bucket.Name == name {
+			return
+		}
+	}
+
+	_, err = s3Client.CreateBucket(context.Background(), &s3.CreateBucketInput{
+		Bucket: utils.StringPtr(name),
+		ACL:    "public-read-write",
+		CreateBucketConfiguration: &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraintEuWest1,
+		},
+	})
+	if err != nil {
+		t.Fatal("Could not create bucket", err)
+	}
+}
+
+// PutS3Object uploads a local file into the access log bucket, on top of the objects ResetAws puts there
+func PutS3Object(t *testing.T, fileName string, s3Location string) {
+	putFileS3(t, "factory-access-log-bucket-int-test", fileName, s3Location)
+}
+
+// PutUsageExportObject uploads a local file into the usage export bucket, which Athena writes query results to
+func PutUsageExportObject(t *testing.T, fileName string, key string) {
+	putFileS3(t, UsageExportBucket, fileName, key)
+}
+
+func putFileS3(t *testing.T, bucket string, fileName string, s3Location string) {
 	file, err := os.Open(fileName)
 	if err != nil {
 		t.Fatal("Could not open file", err)
@@ -284,7 +346,7 @@ func putFileS3(t *testing.T, fileName string, s3Location string) {
 	})
 
 	_, err = dayFileUploader.Upload(context.Background(), &s3.PutObjectInput{
-		Bucket: utils.StringPtr("factory-access-log-bucket-int-test"),
+		Bucket: &bucket,
 		Key:    &s3Location,
 		Body:   file,
 	})
@@ -321,3 +383,49 @@ func ReadS3Object(t *testing.T, bucket string, objectName string) []byte {
 
 	return all
 }
+
+func ListS3Objects(t *testing.T, bucket string, prefix string) []string {
+	setupAWS()
+
+	objects, err := s3Client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	if err != nil {
+		t.Fatal("Unable to list objects", err)
+	}
+
+	keys := make([]string, len(objects.Contents))
+	for i, content := range objects.Contents {
+		keys[i] = *content.Key
+	}
+
+	return keys
+}
+
+func WaitForS3Objects(t *testing.T, bucket string, prefix string, count int) []string {
+	var keys []string
+	var check = func() error {
+		keys = ListS3Objects(t, bucket, prefix)
+		if len(keys) < count {
+			return fmt.Errorf("found %d objects under %s instead of %d", len(keys), prefix, count)
+		}
+
+		return nil
+	}
+
+	err := backoff.Retry(check, &backoff.ExponentialBackOff{
+		InitialInterval:     100 * time.Millisecond,
+		RandomizationFactor: 0.5,
+		Multiplier:          1.2,
+		MaxInterval:         1 * time.Second,
+		MaxElapsedTime:      10 * time.Second,
+		Stop:                -1,
+		Clock:               backoff.SystemClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
@@ -0,0 +1,69 @@
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"subscriptions/src/api"
+	"subscriptions/test/integration/helper"
+	"testing"
+)
+
+func TestClosedMonthIsRolledUpIntoMonthParts(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+	helper.RunTestSetupScript("compaction-ledger-api-key.sql")
+
+	runCronJob(t, "access-log-compaction", false)
+
+	runCronJob(t, "access-log-monthly-rollup", false)
+
+	helper.ReadS3Object(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/month/attempt-1-part-0000.gz")
+	objects := helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/")
+	require.Equal(t, []string{"14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/month/attempt-1-part-0000.gz"}, objects)
+
+	from := int64(1654041600)
+	to := int64(1654041600)
+	resp, err := apiClient.GetSubscriptionsSubscriptionIdCompactionsMonths(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564",
+		&api.GetSubscriptionsSubscriptionIdCompactionsMonthsParams{From: &from, To: &to},
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "compaction-ledger-key")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 200, resp.StatusCode)
+
+	var compactionMonths []api.CompactionMonth
+	err = json.NewDecoder(resp.Body).Decode(&compactionMonths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, len(compactionMonths))
+	require.Equal(t, from, compactionMonths[0].Month)
+	require.Equal(t, "succeeded", compactionMonths[0].Status)
+	require.Equal(t, 3, compactionMonths[0].SourceObjectCount)
+	require.Equal(t, int64(16), compactionMonths[0].RecordCount)
+	require.Equal(t, 1, compactionMonths[0].PartCount)
+}
+
+func TestMonthIsNotRolledUpUntilEveryDayIsCompacted(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("compact-subscription.sql")
+
+	runCronJob(t, "access-log-monthly-rollup", false)
+
+	objects := helper.ListS3Objects(t, "factory-access-log-bucket-int-test", "14fb4f6e-1298-4ca5-989d-00b56a2c6564/2022/06/month/")
+	require.Empty(t, objects)
+}
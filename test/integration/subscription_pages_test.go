@@ -0,0 +1,55 @@
+package integration_test
+
+import (
+	uuid2 "github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	db "subscriptions/src/database"
+	"subscriptions/src/monitoring"
+	"subscriptions/test/integration/helper"
+	"testing"
+)
+
+func TestSubscriptionPagesListEachSubscriptionOnce(t *testing.T) {
+	helper.ResetDatabase()
+	helper.ConnectAppDatabase()
+	helper.RunTestSetupScript("many-subscriptions.sql")
+
+	seen := make(map[uuid2.UUID]int)
+	pages := 0
+	afterId := uuid2.Nil
+	for {
+		page, err := db.GetSubscriptionsPageAfter(monitoring.GlobalContext, 50, afterId)
+		require.NoError(t, err)
+		pages++
+
+		for _, subscription := range page {
+			seen[subscription.Id]++
+		}
+
+		if len(page) < 50 {
+			break
+		}
+
+		afterId = page[len(page)-1].Id
+	}
+
+	require.Equal(t, 3, pages)
+	require.Equal(t, 101, len(seen))
+	for id, count := range seen {
+		require.Equal(t, 1, count, "Subscription %s was listed more than once", id)
+	}
+}
+
+func TestCompactionVisitsEverySubscriptionOnceAcrossPages(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.WaitForS3(t)
+	helper.ResetAws(t)
+	helper.RunTestSetupScript("many-subscriptions.sql")
+
+	run := runCronJob(t, "access-log-compaction", false)
+
+	require.Equal(t, "succeeded", run.Status)
+	require.Equal(t, int64(101), run.Summary.AdditionalProperties["subscriptions"])
+	require.Equal(t, int64(101), run.Summary.AdditionalProperties["succeeded"])
+}
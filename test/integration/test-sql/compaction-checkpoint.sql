@@ -0,0 +1,6 @@
+-- Checkpoints as they were before the compaction ledger, one Subscription has only ever succeeded and one has failed
+INSERT INTO subscription(id, account_id, state, created_at) VALUES ('14fb4f6e-1298-4ca5-989d-00b56a2c6564', 'be372162-c0a0-4903-a9e1-a0b372bb1de9', 2, '2022-06-14T09:00:00+00:00');
+INSERT INTO subscription(id, account_id, state, created_at) VALUES ('c015ce36-76df-4f3f-9352-5daea102d150', '3f2f64d6-3d4c-4c1f-9b9d-1d1b0a0c9e11', 2, '2022-06-14T09:00:00+00:00');
+
+INSERT INTO compaction_checkpoint(subscription_id, succeeded_at, failed_at) VALUES ('14fb4f6e-1298-4ca5-989d-00b56a2c6564', '2022-06-17T03:00:00+00:00', NULL);
+INSERT INTO compaction_checkpoint(subscription_id, succeeded_at, failed_at) VALUES ('c015ce36-76df-4f3f-9352-5daea102d150', '2022-06-17T03:00:00+00:00', '2022-06-16T03:00:00+00:00');
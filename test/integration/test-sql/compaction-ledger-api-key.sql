@@ -0,0 +1,2 @@
+INSERT INTO api_key (owner, api_key) VALUES ('Support', 'compaction-ledger-key');
+INSERT INTO api_key_permission(owner, permission) VALUES ('Support', 'get-compactions');
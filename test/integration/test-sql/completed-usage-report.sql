@@ -0,0 +1,10 @@
+INSERT INTO subscription(id, account_id, state, created_at) VALUES ('14fb4f6e-1298-4ca5-989d-00b56a2c6564', 'be372162-c0a0-4903-a9e1-a0b372bb1de9', 2, '2022-06-14T00:00:00+00:00');
+INSERT INTO usage_report(id, subscription_id, year, month) VALUES ('7a0e62ee-2685-4220-b3b6-3dd0e0c059b9', '14fb4f6e-1298-4ca5-989d-00b56a2c6564', 2022, 6);
+INSERT INTO usage_report_instance(id, usage_report_id, requested_at, athena_query_id, status, attempts, completed_at, breakdowns)
+VALUES ('5b4ec0a8-4c53-4ac6-9bc4-5a2d6ad0c6a3', '7a0e62ee-2685-4220-b3b6-3dd0e0c059b9', NOW() - INTERVAL '1 hour', 'completed-query', 'completed', 1, NOW(), 'device');
+INSERT INTO usage_report_instance_product(usage_report_instance_id, product, value) VALUES ('5b4ec0a8-4c53-4ac6-9bc4-5a2d6ad0c6a3', 'Product A', 54);
+INSERT INTO usage_report_instance_product(usage_report_instance_id, product, value) VALUES ('5b4ec0a8-4c53-4ac6-9bc4-5a2d6ad0c6a3', 'Product B', 122);
+INSERT INTO usage_report_instance_hour(usage_report_instance_id, product, hour, value) VALUES ('5b4ec0a8-4c53-4ac6-9bc4-5a2d6ad0c6a3', 'Product A', '2022-06-18T09:00:00+00:00', 54);
+INSERT INTO usage_report_instance_hour(usage_report_instance_id, product, hour, value) VALUES ('5b4ec0a8-4c53-4ac6-9bc4-5a2d6ad0c6a3', 'Product B', '2022-06-18T09:00:00+00:00', 122);
+INSERT INTO usage_report_instance_breakdown(usage_report_instance_id, breakdown, product, android_id, method, path, value)
+VALUES ('5b4ec0a8-4c53-4ac6-9bc4-5a2d6ad0c6a3', 'device', '', 'tablet-1', '', '', 176);
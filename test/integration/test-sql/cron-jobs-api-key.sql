@@ -0,0 +1,2 @@
+INSERT INTO api_key (owner, api_key) VALUES ('CronAdmin', 'cron-jobs-key') ON CONFLICT DO NOTHING;
+INSERT INTO api_key_permission(owner, permission) VALUES ('CronAdmin', 'manage-cron-jobs') ON CONFLICT DO NOTHING;
@@ -0,0 +1,4 @@
+INSERT INTO subscription(id, account_id, state) VALUES ('c015ce36-76df-4f3f-9352-5daea102d150', 'be372162-c0a0-4903-a9e1-a0b372bb1de9', 2);
+INSERT INTO usage_report(id, subscription_id, year, month) VALUES ('7a0e62ee-2685-4220-b3b6-3dd0e0c059b9', 'c015ce36-76df-4f3f-9352-5daea102d150', 2022, 6);
+INSERT INTO usage_report_instance(id, usage_report_id, requested_at, athena_query_id, status, attempts, failed_at, failure_reason)
+VALUES ('5b4ec0a8-4c53-4ac6-9bc4-5a2d6ad0c6a3', '7a0e62ee-2685-4220-b3b6-3dd0e0c059b9', NOW() - INTERVAL '1 hour', 'failed-query', 'failed', 3, NOW(), 'usage query failed: athena query failed-query: table not found');
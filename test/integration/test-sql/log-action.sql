@@ -0,0 +1,2 @@
+INSERT INTO subscription(id, account_id, state, created_at) VALUES ('14fb4f6e-1298-4ca5-989d-00b56a2c6564', 'be372162-c0a0-4903-a9e1-a0b372bb1de9', 1, '2022-06-14T00:00:00+00:00');
+INSERT INTO subscription(id, account_id, state, created_at) VALUES ('c683d6cd-df69-40aa-b268-58e7237e3225', 'c25b0a05-6a33-4ec5-8c4b-ba0d3c0e5b8b', 2, '2022-06-28T00:00:00+00:00');
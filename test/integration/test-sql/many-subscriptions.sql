@@ -0,0 +1,4 @@
+-- More Subscriptions than the compaction cron reads in a page of 50, created today so they have no days to compact
+INSERT INTO subscription(id, account_id, state, created_at)
+SELECT md5('subscription-' || n)::uuid, md5('account-' || n)::uuid, 2, NOW()
+FROM generate_series(1, 101) AS n;
@@ -0,0 +1 @@
+UPDATE compaction_day SET status = 'failed' WHERE subscription_id = '14fb4f6e-1298-4ca5-989d-00b56a2c6564' AND day = '2022-06-18';
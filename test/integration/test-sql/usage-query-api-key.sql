@@ -0,0 +1,2 @@
+INSERT INTO api_key (owner, api_key) VALUES ('Finance', 'usage-query-key');
+INSERT INTO api_key_permission(owner, permission) VALUES ('Finance', 'query-usage');
@@ -0,0 +1,104 @@
+package integration_test
+
+import (
+	"errors"
+	uuid2 "github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	db "subscriptions/src/database"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/utils"
+	"subscriptions/test/integration/helper"
+	"testing"
+	"time"
+)
+
+// insertRetryingUsageReportInstance adds a usage report instance for the transaction tests to complete.  Its retry is
+// not due for an hour so the poller in the apps leaves it alone.
+func insertRetryingUsageReportInstance(t *testing.T) models.UsageReportInstance {
+	helper.ResetDatabase()
+	helper.ConnectAppDatabase()
+	helper.RunTestSetupScript("usage-report.sql")
+
+	usageReport := models.UsageReport{
+		Id:             uuid2.New(),
+		SubscriptionId: uuid2.MustParse("14fb4f6e-1298-4ca5-989d-00b56a2c6564"),
+		Year:           2022,
+		Month:          6,
+	}
+	require.NoError(t, db.InsertUsageReport(monitoring.GlobalContext, usageReport))
+
+	instance := models.UsageReportInstance{
+		Id:            uuid2.New(),
+		UsageReportId: usageReport.Id,
+		RequestedAt:   time.Now(),
+	}
+	instance.AthenaQueryId = "transaction-test"
+	instance.Status = models.UsageQueryRetrying
+	instance.Attempts = 1
+	instance.NextAttemptAt = utils.TimePtr(time.Now().Add(time.Hour))
+	require.NoError(t, db.InsertUsageReportInstance(monitoring.GlobalContext, instance))
+
+	return instance
+}
+
+// completeUsageReportInstance makes two writes to the instance which should be committed together or not at all
+func completeUsageReportInstance(t *testing.T, transaction *db.Transaction, instance models.UsageReportInstance) {
+	instance.Status = models.UsageQueryCompleted
+	require.NoError(t, db.UpdateUsageReportInstance(monitoring.GlobalContext, transaction, instance))
+
+	require.NoError(t, db.InsertUsageReportInstanceProduct(monitoring.GlobalContext, transaction, models.UsageReportInstanceProduct{
+		UsageReportInstanceId: instance.Id,
+		Product:               "Product A",
+		Value:                 54,
+	}))
+}
+
+func requireUsageReportInstance(t *testing.T, instance models.UsageReportInstance, status models.UsageQueryStatus, productCount int) {
+	instances, err := db.GetUsageReportInstances(monitoring.GlobalContext, instance.UsageReportId)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(instances))
+	require.Equal(t, status, instances[0].Status)
+
+	products, err := db.GetUsageReportInstanceProducts(monitoring.GlobalContext, instance.Id)
+	require.NoError(t, err)
+	require.Equal(t, productCount, len(products))
+}
+
+func TestTransactionIsCommittedWhenTheStatementsSucceed(t *testing.T) {
+	instance := insertRetryingUsageReportInstance(t)
+
+	err := db.WithTransaction(monitoring.GlobalContext, func(transaction *db.Transaction) error {
+		completeUsageReportInstance(t, transaction, instance)
+		return nil
+	})
+	require.NoError(t, err)
+
+	requireUsageReportInstance(t, instance, models.UsageQueryCompleted, 1)
+}
+
+func TestTransactionIsRolledBackWhenTheStatementsReturnAnError(t *testing.T) {
+	instance := insertRetryingUsageReportInstance(t)
+	failed := errors.New("statements failed")
+
+	err := db.WithTransaction(monitoring.GlobalContext, func(transaction *db.Transaction) error {
+		completeUsageReportInstance(t, transaction, instance)
+		return failed
+	})
+	require.ErrorIs(t, err, failed)
+
+	requireUsageReportInstance(t, instance, models.UsageQueryRetrying, 0)
+}
+
+func TestTransactionIsRolledBackWhenTheStatementsPanic(t *testing.T) {
+	instance := insertRetryingUsageReportInstance(t)
+
+	require.PanicsWithValue(t, "statements panicked", func() {
+		_ = db.WithTransaction(monitoring.GlobalContext, func(transaction *db.Transaction) error {
+			completeUsageReportInstance(t, transaction, instance)
+			panic("statements panicked")
+		})
+	})
+
+	requireUsageReportInstance(t, instance, models.UsageQueryRetrying, 0)
+}
@@ -0,0 +1,129 @@
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"subscriptions/src/api"
+	"subscriptions/test/integration/helper"
+	"testing"
+	"time"
+)
+
+func TestUsageQueryCanBeRequestedThenPolledForData(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.RunTestSetupScript("usage-report.sql")
+	helper.RunTestSetupScript("usage-query-api-key.sql")
+
+	withApiKey := func(ctx context.Context, req *http.Request) error {
+		req.Header.Add("X-Api-Key", "usage-query-key")
+		return nil
+	}
+
+	// 2022-06-10 to 2022-06-25
+	request := api.CreateUsageQueryRequest{From: 1654819200, To: 1656115200}
+	createResp, err := apiClient.PostSubscriptionsSubscriptionIdUsageQueries(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564", api.PostSubscriptionsSubscriptionIdUsageQueriesJSONRequestBody(request), withApiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 201, createResp.StatusCode)
+
+	var created api.UsageQuery
+	err = json.NewDecoder(createResp.Body).Decode(&created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "/subscriptions/14fb4f6e-1298-4ca5-989d-00b56a2c6564/usage-queries/"+created.Id.String(),
+		createResp.Header.Get("Location"))
+	require.Equal(t, "processing", created.State)
+	require.Equal(t, request.From, created.From)
+	require.Equal(t, request.To, created.To)
+	require.Equal(t, (*api.UsageCounts)(nil), created.Products)
+
+	// The mock query completes after 5 seconds, then the poller has to pick it up
+	time.Sleep(time.Second * 8)
+
+	getResp, err := apiClient.GetSubscriptionsSubscriptionIdUsageQueriesUsageQueryId(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564", created.Id.String(), withApiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 200, getResp.StatusCode)
+
+	var usageQuery api.UsageQuery
+	err = json.NewDecoder(getResp.Body).Decode(&usageQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, created.Id, usageQuery.Id)
+	require.Equal(t, "ready", usageQuery.State)
+	require.Greater(t, *usageQuery.CompletedAt, time.Now().Add(0-(time.Second*10)).Unix())
+	require.Equal(t, 54, usageQuery.Products.AdditionalProperties["Product A"])
+	require.Equal(t, 122, usageQuery.Products.AdditionalProperties["Product B"])
+}
+
+func TestUsageQueryWithFromNotBeforeToReturns400(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.RunTestSetupScript("usage-report.sql")
+	helper.RunTestSetupScript("usage-query-api-key.sql")
+
+	resp, err := apiClient.PostSubscriptionsSubscriptionIdUsageQueries(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564",
+		api.PostSubscriptionsSubscriptionIdUsageQueriesJSONRequestBody{From: 1656115200, To: 1654819200},
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "usage-query-key")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 400, resp.StatusCode)
+}
+
+func TestUsageQueryWithoutPermissionReturns403(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.RunTestSetupScript("usage-report.sql")
+	helper.RunTestSetupScript("api-keys.sql")
+
+	resp, err := apiClient.PostSubscriptionsSubscriptionIdUsageQueries(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564",
+		api.PostSubscriptionsSubscriptionIdUsageQueriesJSONRequestBody{From: 1654819200, To: 1656115200},
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "valid-key-no-permission")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 403, resp.StatusCode)
+}
+
+func TestUnknownUsageQueryReturns404(t *testing.T) {
+	helper.ResetDatabase()
+	helper.WaitForHealthcheck(t)
+	helper.RunTestSetupScript("usage-report.sql")
+	helper.RunTestSetupScript("usage-query-api-key.sql")
+
+	resp, err := apiClient.GetSubscriptionsSubscriptionIdUsageQueriesUsageQueryId(context.Background(),
+		"14fb4f6e-1298-4ca5-989d-00b56a2c6564", "d456d6cd-df69-40aa-b268-58e1234e3225",
+		func(ctx context.Context, req *http.Request) error {
+			req.Header.Add("X-Api-Key", "usage-query-key")
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 404, resp.StatusCode)
+}
@@ -0,0 +1,268 @@
+package ingestion_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	uuid2 "github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"subscriptions/src/config"
+	"subscriptions/src/ingestion"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+var subscriptionId = uuid2.MustParse("14fb4f6e-1298-4ca5-989d-00b56a2c6564")
+
+// 2022-06-18 09:00 UTC
+const occurredAt = 1655542800
+
+// recordingStore keeps the number of records in each object put into it, failing every put while failing is set
+type recordingStore struct {
+	storage.ObjectStore
+	mutex   sync.Mutex
+	failing bool
+	objects map[string]int
+}
+
+func newRecordingStore() *recordingStore {
+	return &recordingStore{objects: make(map[string]int)}
+}
+
+func (s *recordingStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failing {
+		return errors.New("bucket is unavailable")
+	}
+
+	zipReader, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(zipReader)
+	for scanner.Scan() {
+		lines++
+	}
+
+	s.objects[key] = lines
+	return scanner.Err()
+}
+
+func (s *recordingStore) setFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failing = failing
+}
+
+// recordCounts is the number of records in each object written, in no particular order
+func (s *recordingStore) recordCounts() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var counts []int
+	for key, count := range s.objects {
+		if strings.HasPrefix(key, subscriptionId.String()+"/2022/06/18/") {
+			counts = append(counts, count)
+		}
+	}
+
+	return counts
+}
+
+// startBufferedWriter starts the writer with the test profile, after configure has had the chance to change it
+func startBufferedWriter(t *testing.T, configure func()) *recordingStore {
+	config.LoadProfileFromFile("./test-profiles/buffer.json", "buffer")
+	if configure != nil {
+		configure()
+	}
+
+	monitoring.GlobalContext = monitoring.NewMonitoringContext(zap.NewNop(), context.Background())
+
+	store := newRecordingStore()
+	storage.AccessLogs = store
+
+	ingestion.StartBufferedWriter()
+	t.Cleanup(func() {
+		ingestion.StopBufferedWriter(context.Background())
+	})
+
+	return store
+}
+
+// newRecords makes records which are each approximately 160 bytes when the path is "/"
+func newRecords(count int, path string) []models.AccessLogRecord {
+	records := make([]models.AccessLogRecord, count)
+	for i := range records {
+		records[i] = models.AccessLogRecord{Id: uuid2.New(), OccurredAt: occurredAt, Product: "Product A", Path: path}
+	}
+
+	return records
+}
+
+func bufferRecords(t *testing.T, count int, path string) {
+	require.NoError(t, ingestion.BufferAccessLogs(monitoring.GlobalContext, subscriptionId, newRecords(count, path)))
+}
+
+func TestBufferIsFlushedOnceItHoldsMaxEvents(t *testing.T) {
+	store := startBufferedWriter(t, func() {
+		config.GetConfig().BucketConfig.BufferMaxEvents = 3
+	})
+
+	bufferRecords(t, 2, "/")
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, store.recordCounts())
+
+	bufferRecords(t, 1, "/")
+	assert.Eventually(t, func() bool { return len(store.recordCounts()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []int{3}, store.recordCounts())
+}
+
+func TestBufferIsFlushedOnceItHoldsMaxBytes(t *testing.T) {
+	store := startBufferedWriter(t, func() {
+		config.GetConfig().BucketConfig.BufferMaxBytes = 1000
+	})
+
+	bufferRecords(t, 1, strings.Repeat("/long", 200))
+	assert.Eventually(t, func() bool { return len(store.recordCounts()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []int{1}, store.recordCounts())
+}
+
+func TestBufferIsFlushedOnceItHasBeenHeldForTheFlushInterval(t *testing.T) {
+	store := startBufferedWriter(t, func() {
+		config.GetConfig().BucketConfig.BufferFlushIntervalMs = 100
+	})
+
+	bufferRecords(t, 2, "/")
+	assert.Empty(t, store.recordCounts())
+
+	// Buffers are checked every second
+	assert.Eventually(t, func() bool { return len(store.recordCounts()) == 1 }, 3*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []int{2}, store.recordCounts())
+}
+
+func TestStoppingTheBufferedWriterFlushesEverythingHeld(t *testing.T) {
+	store := startBufferedWriter(t, nil)
+
+	bufferRecords(t, 2, "/")
+	bufferRecords(t, 3, "/")
+	ingestion.StopBufferedWriter(context.Background())
+
+	assert.Equal(t, []int{5}, store.recordCounts())
+}
+
+func TestFailedFlushIsRetriedAfterABackoff(t *testing.T) {
+	store := startBufferedWriter(t, func() {
+		config.GetConfig().BucketConfig.BufferMaxEvents = 2
+	})
+	store.setFailing(true)
+
+	bufferRecords(t, 2, "/")
+
+	// Give the flush time to fail, then let the retry succeed
+	time.Sleep(200 * time.Millisecond)
+	store.setFailing(false)
+	bufferRecords(t, 1, "/")
+
+	// The retry waits out the backoff rather than going straight away on being full again
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, store.recordCounts())
+
+	assert.Eventually(t, func() bool { return len(store.recordCounts()) == 1 }, 3*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []int{3}, store.recordCounts())
+}
+
+func TestRecordsAreRejectedWhileTooMuchIsWaitingToBeWritten(t *testing.T) {
+	store := startBufferedWriter(t, func() {
+		config.GetConfig().BucketConfig.BufferMaxEvents = 2
+		config.GetConfig().BucketConfig.BufferMaxHeldBytes = 400
+	})
+	store.setFailing(true)
+
+	bufferRecords(t, 2, "/")
+	time.Sleep(200 * time.Millisecond)
+
+	err := ingestion.BufferAccessLogs(monitoring.GlobalContext, subscriptionId, newRecords(1, "/"))
+	require.ErrorIs(t, err, ingestion.ErrBufferFull)
+
+	// Once the retry writes what was held there is room again
+	store.setFailing(false)
+	assert.Eventually(t, func() bool { return len(store.recordCounts()) == 1 }, 3*time.Second, 50*time.Millisecond)
+
+	bufferRecords(t, 1, "/")
+	ingestion.StopBufferedWriter(context.Background())
+
+	assert.ElementsMatch(t, []int{2, 1}, store.recordCounts())
+}
+
+func TestSettingsLeftOutOfTheProfileFallBackToDefaults(t *testing.T) {
+	store := startBufferedWriter(t, func() {
+		config.GetConfig().BucketConfig.BufferMaxEvents = 0
+		config.GetConfig().BucketConfig.BufferMaxBytes = 0
+		config.GetConfig().BucketConfig.BufferFlushIntervalMs = 0
+		config.GetConfig().BucketConfig.BufferMaxHeldBytes = 0
+	})
+
+	// Without defaults every record would be flushed on its own, or rejected for going over a cap of nothing
+	bufferRecords(t, 2, "/")
+	bufferRecords(t, 3, "/")
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, store.recordCounts())
+
+	ingestion.StopBufferedWriter(context.Background())
+	assert.Equal(t, []int{5}, store.recordCounts())
+}
+
+func TestStoppingTheBufferedWriterRetriesWhatFailedToWriteWhileDraining(t *testing.T) {
+	store := startBufferedWriter(t, nil)
+	store.setFailing(true)
+
+	bufferRecords(t, 2, "/")
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		store.setFailing(false)
+	}()
+	ingestion.StopBufferedWriter(context.Background())
+
+	assert.Equal(t, []int{2}, store.recordCounts())
+}
+
+func TestRecordsBufferedAfterStoppingAreWrittenStraightAway(t *testing.T) {
+	store := startBufferedWriter(t, nil)
+	ingestion.StopBufferedWriter(context.Background())
+
+	bufferRecords(t, 2, "/")
+
+	assert.Equal(t, []int{2}, store.recordCounts())
+}
+
+func TestStoppingTheBufferedWriterGivesUpOnceTheDeadlinePasses(t *testing.T) {
+	store := startBufferedWriter(t, nil)
+	store.setFailing(true)
+
+	bufferRecords(t, 2, "/")
+
+	deadline, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// Left alone the last attempts at the failed write would carry on for five seconds
+	stopping := time.Now()
+	ingestion.StopBufferedWriter(deadline)
+
+	assert.Less(t, time.Since(stopping), 2*time.Second)
+	assert.Empty(t, store.recordCounts())
+}
@@ -0,0 +1,126 @@
+package services_test
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/stretchr/testify/require"
+	"subscriptions/src/models"
+	"subscriptions/src/services"
+	"subscriptions/src/utils"
+	"testing"
+	"time"
+)
+
+func resultRow(values ...*string) types.Row {
+	data := make([]types.Datum, len(values))
+	for i, value := range values {
+		data[i] = types.Datum{VarCharValue: value}
+	}
+
+	return types.Row{Data: data}
+}
+
+func header() types.Row {
+	return resultRow(utils.StringPtr("grouping"), utils.StringPtr("product"), utils.StringPtr("android_id"),
+		utils.StringPtr("method"), utils.StringPtr("path"), utils.StringPtr("hour"), utils.StringPtr("value"))
+}
+
+func TestParseAthenaResultSetSkipsHeaderOnFirstPageOnly(t *testing.T) {
+	firstPage, err := services.ParseAthenaResultSet(&types.ResultSet{Rows: []types.Row{
+		header(),
+		resultRow(utils.StringPtr("15"), utils.StringPtr("Product A"), nil, nil, nil, nil, utils.StringPtr("54")),
+	}}, true)
+	require.NoError(t, err)
+	require.Equal(t, []services.ProductUsage{{Product: "Product A", Value: 54}}, firstPage.Products)
+
+	secondPage, err := services.ParseAthenaResultSet(&types.ResultSet{Rows: []types.Row{
+		resultRow(utils.StringPtr("15"), utils.StringPtr("Product B"), nil, nil, nil, nil, utils.StringPtr("122")),
+	}}, false)
+	require.NoError(t, err)
+	require.Equal(t, []services.ProductUsage{{Product: "Product B", Value: 122}}, secondPage.Products)
+}
+
+func TestParseAthenaResultSetReadsHourlySeries(t *testing.T) {
+	results, err := services.ParseAthenaResultSet(&types.ResultSet{Rows: []types.Row{
+		header(),
+		resultRow(utils.StringPtr("14"), utils.StringPtr("Product A"), nil, nil, nil, utils.StringPtr("1655542800"), utils.StringPtr("50")),
+	}}, true)
+	require.NoError(t, err)
+	require.Equal(t, []services.HourlyProductUsage{
+		{Product: "Product A", Hour: time.Date(2022, 6, 18, 9, 0, 0, 0, time.UTC), Value: 50},
+	}, results.Series)
+}
+
+func TestParseAthenaResultSetCountsNullFieldsAsEmpty(t *testing.T) {
+	results, err := services.ParseAthenaResultSet(&types.ResultSet{Rows: []types.Row{
+		header(),
+		resultRow(utils.StringPtr("15"), nil, nil, nil, nil, nil, utils.StringPtr("3")),
+	}}, true)
+	require.NoError(t, err)
+	require.Equal(t, []services.ProductUsage{{Product: "", Value: 3}}, results.Products)
+}
+
+func TestNullAndEmptyFieldsAreCombinedIntoOneCount(t *testing.T) {
+	empty := utils.StringPtr("")
+	results, err := services.ParseAthenaResultSet(&types.ResultSet{Rows: []types.Row{
+		header(),
+		resultRow(utils.StringPtr("15"), nil, nil, nil, nil, nil, utils.StringPtr("3")),
+		resultRow(utils.StringPtr("15"), empty, nil, nil, nil, nil, utils.StringPtr("2")),
+		resultRow(utils.StringPtr("15"), utils.StringPtr("Product A"), nil, nil, nil, nil, utils.StringPtr("4")),
+		resultRow(utils.StringPtr("23"), nil, nil, nil, nil, nil, utils.StringPtr("5")),
+		resultRow(utils.StringPtr("23"), nil, empty, nil, nil, nil, utils.StringPtr("1")),
+		resultRow(utils.StringPtr("25"), nil, nil, utils.StringPtr("GET"), nil, nil, utils.StringPtr("6")),
+		resultRow(utils.StringPtr("25"), nil, nil, utils.StringPtr("GET"), empty, nil, utils.StringPtr("7")),
+	}}, true)
+	require.NoError(t, err)
+
+	combined := results.Combined()
+	require.Equal(t, []services.ProductUsage{{Product: "", Value: 5}, {Product: "Product A", Value: 4}}, combined.Products)
+	require.Equal(t, []services.BreakdownUsage{
+		{Breakdown: models.UsageReportBreakdownDevice, Value: 6},
+		{Breakdown: models.UsageReportBreakdownEndpoint, Method: "GET", Value: 13},
+	}, combined.Breakdowns)
+}
+
+func TestParseAthenaResultSetReadsBreakdownsByGrouping(t *testing.T) {
+	results, err := services.ParseAthenaResultSet(&types.ResultSet{Rows: []types.Row{
+		header(),
+		resultRow(utils.StringPtr("23"), nil, utils.StringPtr("tablet-1"), nil, nil, nil, utils.StringPtr("5")),
+		resultRow(utils.StringPtr("25"), nil, nil, utils.StringPtr("GET"), utils.StringPtr("/a"), nil, utils.StringPtr("4")),
+		resultRow(utils.StringPtr("7"), utils.StringPtr("Product A"), utils.StringPtr("tablet-1"), nil, nil, nil, utils.StringPtr("2")),
+	}}, true)
+	require.NoError(t, err)
+	require.Empty(t, results.Products)
+	require.Equal(t, []services.BreakdownUsage{
+		{Breakdown: models.UsageReportBreakdownDevice, AndroidId: "tablet-1", Value: 5},
+		{Breakdown: models.UsageReportBreakdownEndpoint, Method: "GET", Path: "/a", Value: 4},
+		{Breakdown: models.UsageReportBreakdownProductDevice, Product: "Product A", AndroidId: "tablet-1", Value: 2},
+	}, results.Breakdowns)
+}
+
+func TestParseAthenaResultSetRejectsInvalidResults(t *testing.T) {
+	row := func(grouping *string, count *string) types.Row {
+		return resultRow(grouping, utils.StringPtr("Product A"), nil, nil, nil, nil, count)
+	}
+	product := utils.StringPtr("15")
+
+	cases := map[string]*types.ResultSet{
+		"no result set":      nil,
+		"no header":          {Rows: []types.Row{}},
+		"unexpected header":  {Rows: []types.Row{resultRow(utils.StringPtr("product"), utils.StringPtr("_col1"))}},
+		"too few columns":    {Rows: []types.Row{header(), resultRow(product, utils.StringPtr("Product A"))}},
+		"unknown grouping":   {Rows: []types.Row{header(), row(utils.StringPtr("1"), utils.StringPtr("1"))}},
+		"null grouping":      {Rows: []types.Row{header(), row(nil, utils.StringPtr("1"))}},
+		"non-integer hour":   {Rows: []types.Row{header(), resultRow(utils.StringPtr("14"), utils.StringPtr("Product A"), nil, nil, nil, utils.StringPtr("noon"), utils.StringPtr("1"))}},
+		"null count":         {Rows: []types.Row{header(), row(product, nil)}},
+		"non-integer count":  {Rows: []types.Row{header(), row(product, utils.StringPtr("1.5"))}},
+		"negative count":     {Rows: []types.Row{header(), row(product, utils.StringPtr("-1"))}},
+		"count out of range": {Rows: []types.Row{header(), row(product, utils.StringPtr("99999999999"))}},
+	}
+
+	for name, resultSet := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := services.ParseAthenaResultSet(resultSet, true)
+			require.Error(t, err)
+		})
+	}
+}
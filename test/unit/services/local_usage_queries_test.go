@@ -0,0 +1,226 @@
+package services_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	uuid2 "github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"subscriptions/src/models"
+	"subscriptions/src/monitoring"
+	"subscriptions/src/services"
+	"subscriptions/src/storage"
+	"testing"
+	"time"
+)
+
+var monitoringContext = monitoring.NewMonitoringContext(zap.NewNop(), context.Background())
+
+var (
+	june = time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	july = time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func putGzippedLines(t *testing.T, store storage.ObjectStore, key string, lines ...string) {
+	var buf bytes.Buffer
+	zipWriter := gzip.NewWriter(&buf)
+	_, err := zipWriter.Write([]byte(strings.Join(lines, "\n")))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+
+	require.NoError(t, store.Put(context.Background(), key, &buf, nil))
+}
+
+func TestLocalBackendCountsRecordsInTheMonthByProduct(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	subscriptionId := uuid2.MustParse("14fb4f6e-1298-4ca5-989d-00b56a2c6564")
+	prefix := subscriptionId.String()
+
+	putGzippedLines(t, store, prefix+"/2022/06/18/day.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a01","Product":"Product A","OccurredAt":1655542800}`,
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a02","Product":"Product B","OccurredAt":1655542800}`)
+	putGzippedLines(t, store, prefix+"/2022/06/19/1.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a03","Product":"Product A","OccurredAt":1655629200}`,
+		`not json`)
+	putGzippedLines(t, store, prefix+"/2022/07/01/1.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a04","Product":"Product A","OccurredAt":1656666000}`)
+
+	backend := services.NewLocalUsageQueryBackend(store, nil)
+	queryId, err := backend.StartQuery(monitoringContext, subscriptionId, june, july, nil)
+	require.NoError(t, err)
+
+	completed, results, err := backend.GetResults(monitoringContext, queryId)
+	require.NoError(t, err)
+	assert.True(t, completed)
+	assert.Equal(t, []services.ProductUsage{{Product: "Product A", Value: 2}, {Product: "Product B", Value: 1}}, results.Products)
+	assert.Empty(t, results.Breakdowns)
+}
+
+func TestLocalBackendReturnsNoProductsForAnEmptyMonth(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+
+	backend := services.NewLocalUsageQueryBackend(store, nil)
+	queryId, err := backend.StartQuery(monitoringContext, uuid2.New(), june, july, nil)
+	require.NoError(t, err)
+
+	completed, results, err := backend.GetResults(monitoringContext, queryId)
+	require.NoError(t, err)
+	assert.True(t, completed)
+	assert.Empty(t, results.Products)
+}
+
+func TestLocalBackendFailsTheQueryForAnObjectWhichIsNotGzip(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	subscriptionId := uuid2.New()
+	require.NoError(t, store.Put(context.Background(), subscriptionId.String()+"/2022/06/18/1.gz",
+		strings.NewReader("not gzip"), nil))
+
+	backend := services.NewLocalUsageQueryBackend(store, nil)
+	queryId, err := backend.StartQuery(monitoringContext, subscriptionId, june, july, nil)
+	require.NoError(t, err)
+
+	completed, _, err := backend.GetResults(monitoringContext, queryId)
+	assert.ErrorIs(t, err, services.ErrQueryFailed)
+	assert.False(t, completed)
+}
+
+func TestLocalBackendFailsTheQueryForATruncatedObject(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	subscriptionId := uuid2.New()
+
+	var buf bytes.Buffer
+	zipWriter := gzip.NewWriter(&buf)
+	_, err := zipWriter.Write([]byte(`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a01","Product":"Product A","OccurredAt":1655542800}`))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	truncated := buf.Bytes()[:buf.Len()-10]
+	require.NoError(t, store.Put(context.Background(), subscriptionId.String()+"/2022/06/18/1.gz",
+		bytes.NewReader(truncated), nil))
+
+	backend := services.NewLocalUsageQueryBackend(store, nil)
+	queryId, err := backend.StartQuery(monitoringContext, subscriptionId, june, july, nil)
+	require.NoError(t, err)
+
+	completed, _, err := backend.GetResults(monitoringContext, queryId)
+	assert.ErrorIs(t, err, services.ErrQueryFailed)
+	assert.False(t, completed)
+}
+
+func TestLocalBackendCountsRequestedBreakdowns(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	subscriptionId := uuid2.MustParse("14fb4f6e-1298-4ca5-989d-00b56a2c6564")
+
+	putGzippedLines(t, store, subscriptionId.String()+"/2022/06/18/day.gz",
+		`{"Product":"Product A","AndroidId":"tablet-1","Method":"GET","Path":"/a","OccurredAt":1655542800}`,
+		`{"Product":"Product A","AndroidId":"tablet-2","Method":"GET","Path":"/a","OccurredAt":1655546399}`,
+		`{"Product":"Product B","AndroidId":"tablet-1","Method":"POST","Path":"/a","OccurredAt":1655546400}`)
+
+	backend := services.NewLocalUsageQueryBackend(store, nil)
+	breakdowns := models.UsageReportBreakdowns{models.UsageReportBreakdownDevice, models.UsageReportBreakdownEndpoint}
+	queryId, err := backend.StartQuery(monitoringContext, subscriptionId, june, july, breakdowns)
+	require.NoError(t, err)
+
+	completed, results, err := backend.GetResults(monitoringContext, queryId)
+	require.NoError(t, err)
+	assert.True(t, completed)
+	assert.Equal(t, []services.ProductUsage{{Product: "Product A", Value: 2}, {Product: "Product B", Value: 1}}, results.Products)
+	assert.Equal(t, []services.BreakdownUsage{
+		{Breakdown: models.UsageReportBreakdownDevice, AndroidId: "tablet-1", Value: 2},
+		{Breakdown: models.UsageReportBreakdownDevice, AndroidId: "tablet-2", Value: 1},
+		{Breakdown: models.UsageReportBreakdownEndpoint, Method: "GET", Path: "/a", Value: 2},
+		{Breakdown: models.UsageReportBreakdownEndpoint, Method: "POST", Path: "/a", Value: 1},
+	}, results.Breakdowns)
+	nineAm := time.Date(2022, 6, 18, 9, 0, 0, 0, time.UTC)
+	assert.Equal(t, []services.HourlyProductUsage{
+		{Product: "Product A", Hour: nineAm, Value: 2},
+		{Product: "Product B", Hour: nineAm.Add(time.Hour), Value: 1},
+	}, results.Series)
+}
+
+func TestLocalBackendCountsRecordsWhichOccurredInARangeAcrossMonths(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	subscriptionId := uuid2.MustParse("14fb4f6e-1298-4ca5-989d-00b56a2c6564")
+	prefix := subscriptionId.String()
+
+	putGzippedLines(t, store, prefix+"/2022/06/09/day.gz",
+		`{"Product":"Product A","OccurredAt":1654790399}`)
+	putGzippedLines(t, store, prefix+"/2022/06/10/day.gz",
+		`{"Product":"Product A","OccurredAt":1654819200}`,
+		`{"Product":"Product B","OccurredAt":1654819200}`)
+	putGzippedLines(t, store, prefix+"/2022/07/04/1.gz",
+		`{"Product":"Product A","OccurredAt":1656979199}`,
+		`{"Product":"Product A","OccurredAt":1656979200}`)
+	putGzippedLines(t, store, prefix+"/2022/08/01/1.gz",
+		`{"Product":"Product B","OccurredAt":1659312000}`)
+
+	backend := services.NewLocalUsageQueryBackend(store, nil)
+	from := time.Date(2022, 6, 10, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 7, 5, 0, 0, 0, 0, time.UTC)
+	queryId, err := backend.StartQuery(monitoringContext, subscriptionId, from, to, nil)
+	require.NoError(t, err)
+
+	completed, results, err := backend.GetResults(monitoringContext, queryId)
+	require.NoError(t, err)
+	assert.True(t, completed)
+	assert.Equal(t, []services.ProductUsage{{Product: "Product A", Value: 2}, {Product: "Product B", Value: 1}}, results.Products)
+}
+
+func TestLocalBackendCountsARecordWrittenMoreThanOnceOnce(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	subscriptionId := uuid2.MustParse("14fb4f6e-1298-4ca5-989d-00b56a2c6564")
+	prefix := subscriptionId.String()
+
+	putGzippedLines(t, store, prefix+"/2022/06/18/day.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a01","Product":"Product A","OccurredAt":1655542800}`)
+	putGzippedLines(t, store, prefix+"/2022/06/18/1.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a01","Product":"Product A","OccurredAt":1655542800}`,
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a02","Product":"Product A","OccurredAt":1655542800}`)
+
+	backend := services.NewLocalUsageQueryBackend(store, nil)
+	queryId, err := backend.StartQuery(monitoringContext, subscriptionId, june, july, nil)
+	require.NoError(t, err)
+
+	completed, results, err := backend.GetResults(monitoringContext, queryId)
+	require.NoError(t, err)
+	assert.True(t, completed)
+	assert.Equal(t, []services.ProductUsage{{Product: "Product A", Value: 2}}, results.Products)
+}
+
+func TestLocalBackendWritesRawResultsOnceForEachIdAsCsv(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	exports := storage.NewFilesystemStore(t.TempDir(), "exports")
+	subscriptionId := uuid2.MustParse("14fb4f6e-1298-4ca5-989d-00b56a2c6564")
+	prefix := subscriptionId.String()
+
+	putGzippedLines(t, store, prefix+"/2022/06/18/day.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a01","Product":"Product A","Method":"GET","Path":"/a","AndroidId":"tablet-1","OccurredAt":1655542800}`)
+	putGzippedLines(t, store, prefix+"/2022/06/18/1.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a01","Product":"Product A","Method":"GET","Path":"/a","AndroidId":"tablet-1","OccurredAt":1655542800}`,
+		`{"Product":"Product B","OccurredAt":1655546400}`)
+	putGzippedLines(t, store, prefix+"/2022/07/01/1.gz",
+		`{"Id":"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a03","Product":"Product A","OccurredAt":1656666000}`)
+
+	backend := services.NewLocalUsageQueryBackend(store, exports)
+	queryId, err := backend.StartRawQuery(monitoringContext, subscriptionId, june, july)
+	require.NoError(t, err)
+
+	completed, key, err := backend.GetRawResults(monitoringContext, queryId)
+	require.NoError(t, err)
+	assert.True(t, completed)
+
+	body, err := exports.Get(context.Background(), key)
+	require.NoError(t, err)
+	defer body.Close()
+	contents, err := io.ReadAll(body)
+	require.NoError(t, err)
+
+	assert.Equal(t, strings.Join([]string{
+		"id,occurred_at,product,method,path,android_id",
+		"5f6f5f0e-8a2f-4a5e-9a57-0d1f6c0f0a01,1655542800,Product A,GET,/a,tablet-1",
+		",1655546400,Product B,,,",
+	}, "\n")+"\n", string(contents))
+}
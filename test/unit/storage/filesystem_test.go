@@ -0,0 +1,103 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"subscriptions/src/storage"
+	"testing"
+	"time"
+)
+
+func put(t *testing.T, store storage.ObjectStore, key string, content string) {
+	err := store.Put(context.Background(), key, strings.NewReader(content), nil)
+	require.NoError(t, err)
+}
+
+func TestFilesystemStoreGetsWhatWasPut(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	put(t, store, "sub/2022/06/18/1.gz", "content")
+
+	body, err := store.Get(context.Background(), "sub/2022/06/18/1.gz")
+	require.NoError(t, err)
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+}
+
+func TestFilesystemStoreReturnsNotFoundForMissingObject(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+
+	_, err := store.Get(context.Background(), "sub/2022/06/18/day.gz")
+	assert.True(t, errors.Is(err, storage.ErrNotFound))
+}
+
+func TestFilesystemStoreListsByPrefixInPages(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	put(t, store, "sub/2022/06/18/2.gz", "22")
+	put(t, store, "sub/2022/06/18/1.gz", "1")
+	put(t, store, "sub/2022/06/18/day.gz", "333")
+	put(t, store, "sub/2022/06/19/1.gz", "4444")
+
+	first, err := store.List(context.Background(), "sub/2022/06/18", nil, 2)
+	require.NoError(t, err)
+	require.NotNil(t, first.NextToken)
+	assert.Equal(t, []storage.ObjectInfo{{Key: "sub/2022/06/18/1.gz", Size: 1}, {Key: "sub/2022/06/18/2.gz", Size: 2}}, first.Objects)
+
+	second, err := store.List(context.Background(), "sub/2022/06/18", first.NextToken, 2)
+	require.NoError(t, err)
+	assert.Nil(t, second.NextToken)
+	assert.Equal(t, []storage.ObjectInfo{{Key: "sub/2022/06/18/day.gz", Size: 3}}, second.Objects)
+}
+
+func TestFilesystemStoreListsNothingForMissingPrefix(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+
+	page, err := store.List(context.Background(), "sub/2022/06/18/", nil, 1000)
+	require.NoError(t, err)
+	assert.Empty(t, page.Objects)
+	assert.Nil(t, page.NextToken)
+}
+
+func TestFilesystemStoreDeletesObjects(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	put(t, store, "sub/2022/06/18/1.gz", "content")
+
+	require.NoError(t, store.Delete(context.Background(), "sub/2022/06/18/1.gz"))
+	require.NoError(t, store.Delete(context.Background(), "sub/2022/06/18/1.gz"))
+
+	_, err := store.Get(context.Background(), "sub/2022/06/18/1.gz")
+	assert.True(t, errors.Is(err, storage.ErrNotFound))
+}
+
+func TestFilesystemStoreLeavesNothingBehindWhenMultipartBodyFails(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("partial"))
+		writer.CloseWithError(errors.New("upload abandoned"))
+	}()
+
+	err := store.PutMultipart(context.Background(), "sub/2022/06/day.gz", reader)
+	require.Error(t, err)
+
+	page, err := store.List(context.Background(), "sub/", nil, 1000)
+	require.NoError(t, err)
+	assert.Empty(t, page.Objects)
+}
+
+func TestFilesystemStorePresignsFileUrl(t *testing.T) {
+	store := storage.NewFilesystemStore(t.TempDir(), "bucket")
+	put(t, store, "exports/report.csv", "a,b")
+
+	url, err := store.Presign(context.Background(), "exports/report.csv", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(url, "file://"))
+	assert.True(t, strings.HasSuffix(url, "/bucket/exports/report.csv"))
+}